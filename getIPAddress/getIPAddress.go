@@ -7,10 +7,149 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 )
 
+// vmsGetV2 is the part of the v2 /vms response including the NIC config
+type vmsGetV2 struct {
+	Entities []struct {
+		UUID   string `json:"uuid"`
+		Name   string `json:"name"`
+		VMNics []struct {
+			MacAddress         string   `json:"mac_address"`
+			NetworkUUID        string   `json:"network_uuid"`
+			RequestedIPAddress string   `json:"requested_ip_address"`
+			IPAddress          string   `json:"ip_address"`
+			IPAddresses        []string `json:"ip_addresses"`
+		} `json:"vm_nics"`
+	} `json:"entities"`
+}
+
+// vmsGetV1 is the part of the v1 /vms response including the guest reported IPs
+type vmsGetV1 struct {
+	Entities []struct {
+		UUID        string   `json:"uuid"`
+		VMName      string   `json:"vmName"`
+		IPAddresses []string `json:"ipAddresses"`
+	} `json:"entities"`
+}
+
+// networksGetV2 is the part of the v2 /networks response to resolve network names
+type networksGetV2 struct {
+	Entities []struct {
+		UUID   string `json:"uuid"`
+		Name   string `json:"name"`
+		VlanID int    `json:"vlan_id"`
+	} `json:"entities"`
+}
+
+// ipSource notes from which API an IP address is known
+type ipSource string
+
+const (
+	sourceRequested ipSource = "requested (v2 AHV managed)"
+	sourceNic       ipSource = "nic (v2)"
+	sourceGuest     ipSource = "guest (v1)"
+)
+
+// ipEntry is a single IP address with all the sources reporting it
+type ipEntry struct {
+	IP      string
+	Sources []ipSource
+}
+
+// version returns IPv4 or IPv6 for the IP address
+func (e ipEntry) version() string {
+	if ip := net.ParseIP(e.IP); ip != nil && ip.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// sources returns the sources comma separated
+func (e ipEntry) sources() string {
+	var names []string
+	for _, s := range e.Sources {
+		names = append(names, string(s))
+	}
+	return strings.Join(names, ", ")
+}
+
+// ipList collects IP addresses and merges the sources of the same address
+type ipList []*ipEntry
+
+// add adds the ip with its source to the list
+func (l *ipList) add(ip string, source ipSource) {
+	if ip == "" {
+		return
+	}
+	for _, e := range *l {
+		if e.IP == ip {
+			for _, s := range e.Sources {
+				if s == source {
+					return
+				}
+			}
+			e.Sources = append(e.Sources, source)
+			return
+		}
+	}
+	*l = append(*l, &ipEntry{IP: ip, Sources: []ipSource{source}})
+}
+
+// has returns true if the ip is already in the list
+func (l ipList) has(ip string) bool {
+	for _, e := range l {
+		if e.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// print prints the IPv4 addresses first and then the IPv6 addresses
+func (l ipList) print(indent string) {
+	for _, version := range []string{"IPv4", "IPv6"} {
+		for _, e := range l {
+			if e.version() == version {
+				fmt.Printf("%s%s %s [%s]\n", indent, version, e.IP, e.sources())
+			}
+		}
+	}
+}
+
+// getJSON sends a GET to the url and unmarshals the response into v
+func getJSON(httpClient *http.Client, url string, username string, password string, v interface{}) error {
+
+	req, _ := http.NewRequest("GET", url, nil)
+
+	// before the request is send set the HTTP Header key "Authorization" with
+	// the value of base64 encoded Username and Password
+	req.Header.Set("Authorization", "Basic "+EncodeCredentials(username, password))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// read the data from the resp.body into bodyText
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	return json.Unmarshal(bodyText, v)
+}
+
 // EncodeCredentials this func is encoding the Username and Password with base64 encoding which is
 // required for Nutanix
 func EncodeCredentials(username string, password string) string {
@@ -60,107 +199,92 @@ func main() {
 	}
 
 	// create a HTTP client
-	var httpClient = http.Client{Transport: tr}
-
-	// create a http Request pointer
-	var req *http.Request
-	var err error
+	var httpClient = &http.Client{Transport: tr}
 
-	// Defines the HTTP Request
-	// send a GET to the NUTANIX API and receives the UUID of the VM "docker-mac"
-
-	req, _ = http.NewRequest("GET", v2_0(NutanixHost)+"/vms/?include_vm_nic_config=true", nil)
-
-	// before the request is send set the HTTP Header key "Authorization" with
-	// the value of base64 encoded Username and Password
-	req.Header.Set("Authorization", "Basic "+EncodeCredentials(username, password))
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	// send a GET to the NUTANIX API and receives all VMs including the NIC config
+	var v2 vmsGetV2
+	if err := getJSON(httpClient, v2_0(NutanixHost)+"/vms/?include_vm_nic_config=true", username, password, &v2); err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	// read the data from the resp.body into bodyText
-	bodyText, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	// the v2 API does not return the IPs reported by the guest, so the v1 API
+	// is used to receive the ipAddresses of all VMs
+	var v1 vmsGetV1
+	if err := getJSON(httpClient, v1_0(NutanixHost)+"/vms/", username, password, &v1); err != nil {
 		log.Fatal(err)
+		os.Exit(1)
 	}
 
-	// create interface
-	var f interface{}
-
-	// Unmarshal into interface f
-	if err2 := json.Unmarshal(bodyText, &f); err != nil {
-		panic(err2)
+	// the network names are used to make the NICs readable
+	var networks networksGetV2
+	if err := getJSON(httpClient, v2_0(NutanixHost)+"/networks/", username, password, &networks); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
 	}
 
-	// type assertion to access f´s underlying map[string]interface
-	m := f.(map[string]interface{})
+	networkNames := make(map[string]string)
+	for _, n := range networks.Entities {
+		networkNames[n.UUID] = fmt.Sprintf("%s (vlan %d)", n.Name, n.VlanID)
+	}
 
-	// the response will include entities which includes the data of the VMs we searching for
-	e := m["entities"].([]interface{})
+	// both responses are joined by the VM UUID
+	guestIPs := make(map[string][]string)
+	for _, vm := range v1.Entities {
+		guestIPs[vm.UUID] = vm.IPAddresses
+	}
 
-	// we can iterate through the map and search for the IP of the VM
-	for k := range e {
-		t := e[k].(map[string]interface{})
+	sort.Slice(v2.Entities, func(i, j int) bool { return v2.Entities[i].Name < v2.Entities[j].Name })
 
-		fmt.Println(t["name"])
+	for _, vm := range v2.Entities {
 
-		if t["vm_nics"] != nil {
-			n := t["vm_nics"].([]interface{})
+		fmt.Printf("%s (%s)\n", vm.Name, vm.UUID)
 
-			for k2 := range n {
-				t2 := n[k2].(map[string]interface{})
+		// IPs reported by the guest are assigned to the NIC which has the IP
+		// configured, all others can not be mapped to a NIC
+		assigned := ipList{}
 
-				fmt.Print("AHV managed: ")
-				fmt.Println(t2["requested_ip_address"])
+		for _, nic := range vm.VMNics {
 
+			network, ok := networkNames[nic.NetworkUUID]
+			if !ok {
+				network = nic.NetworkUUID
 			}
+			fmt.Printf("  NIC %s network %s\n", nic.MacAddress, network)
 
-		}
-
-	}
-
-	// Defines the HTTP Request
-	// send a GET to the NUTANIX API and receives the details of all VMs
-
-	req, _ = http.NewRequest("GET", v1_0(NutanixHost)+"/vms/", nil)
-
-	// before the request is send set the HTTP Header key "Authorization" with
-	// the value of base64 encoded Username and Password
-	req.Header.Set("Authorization", "Basic "+EncodeCredentials(username, password))
-
-	resp, err = httpClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
-	}
-	defer resp.Body.Close()
+			ips := ipList{}
+			ips.add(nic.RequestedIPAddress, sourceRequested)
+			ips.add(nic.IPAddress, sourceNic)
+			for _, ip := range nic.IPAddresses {
+				ips.add(ip, sourceNic)
+			}
 
-	// read the data from the resp.body into bodyText
-	bodyText, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
+			for _, ip := range guestIPs[vm.UUID] {
+				if ips.has(ip) {
+					ips.add(ip, sourceGuest)
+				}
+			}
 
-	// Unmarshal into interface f
-	if err2 := json.Unmarshal(bodyText, &f); err != nil {
-		panic(err2)
-	}
+			if len(ips) == 0 {
+				fmt.Println("    no IP address known")
+			}
+			ips.print("    ")
 
-	m = f.(map[string]interface{})
+			assigned = append(assigned, ips...)
+		}
 
-	// the response will include entities which includes the data of the VMs we searching for
-	e = m["entities"].([]interface{})
+		unassigned := ipList{}
+		for _, ip := range guestIPs[vm.UUID] {
+			if !assigned.has(ip) {
+				unassigned.add(ip, sourceGuest)
+			}
+		}
 
-	// we can iterate through the map and search for the IP of the VM
-	for k := range e {
-		t := e[k].(map[string]interface{})
+		if len(unassigned) > 0 {
+			fmt.Println("  not mapped to a NIC")
+			unassigned.print("    ")
+		}
 
-		fmt.Print("V1 Workaround: ")
-		fmt.Println(t["ipAddresses"])
 	}
 
 }
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 )
 
 // EncodeCredentials this func is encoding the Username and Password with base64 encoding which is
@@ -38,38 +44,78 @@ func v2_0(NutanixHost string) string {
 
 }
 
-// v3_0 returns the main entry point for the v3.0 Nutanix API -> Not GA with AOS 5.0
+// v3_0 returns the main entry point for the v3.0 Nutanix API
 func v3_0(NutanixHost string) string {
 
-	return "https://" + NutanixHost + ":9440/PrismGateway/services/rest/v3.0/"
+	return "https://" + NutanixHost + ":9440/api/nutanix/v3/"
 
 }
 
-func main() {
-
-	// PRISM user
-	var username = "admin"
-	// PRISM user password
-	var password = "nutanix/4u"
-	// Nutanix Cluster IP/DNSName CVM IP/DNSName
-	var NutanixHost = "192.168.178.130"
+// vmSelector describes how the VMs to operate on are chosen. Exactly one of
+// Name, Glob, Regex, UUID or Category has to be set.
+type vmSelector struct {
+	Name     string
+	Glob     string
+	Regex    string
+	UUID     string
+	Category string
+	All      bool
+}
 
-	// Ignores certificates which can not be validated
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// describe returns a human readable form of the selector for error messages
+func (s vmSelector) describe() string {
+	switch {
+	case s.Name != "":
+		return "name " + s.Name
+	case s.Glob != "":
+		return "glob " + s.Glob
+	case s.Regex != "":
+		return "regex " + s.Regex
+	case s.UUID != "":
+		return "uuid prefix " + s.UUID
 	}
+	return "category " + s.Category
+}
 
-	// create a HTTP client
-	var httpClient = http.Client{Transport: tr}
-
-	// create a http Request pointer
-	var req *http.Request
-	var err error
+// validate makes sure exactly one selection criteria is set
+func (s vmSelector) validate() error {
+	n := 0
+	for _, v := range []string{s.Name, s.Glob, s.Regex, s.UUID, s.Category} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of -name, -glob, -regex, -uuid or -category is required")
+	}
+	if s.Category != "" && !strings.Contains(s.Category, ":") {
+		return errors.New("category has to be given as key:value")
+	}
+	return nil
+}
 
-	// Defines the HTTP Request
-	// send a GET to the NUTANIX API and receives the UUID of the VM "docker-mac"
+// matches returns true if the VM t from the /vms list matches the name, glob,
+// regex or uuid prefix of the selector
+func (s vmSelector) matches(t map[string]interface{}, re *regexp.Regexp) bool {
+	name, _ := t["name"].(string)
+	uuid, _ := t["uuid"].(string)
+
+	switch {
+	case s.Name != "":
+		return name == s.Name
+	case s.Glob != "":
+		ok, _ := path.Match(s.Glob, name)
+		return ok
+	case s.Regex != "":
+		return re.MatchString(name)
+	case s.UUID != "":
+		return strings.HasPrefix(strings.ToLower(uuid), strings.ToLower(s.UUID))
+	}
+	return false
+}
 
-	req, _ = http.NewRequest("GET", v2_0(NutanixHost)+"/vms", nil)
+// doRequest sends the request with basic auth and unmarshals the JSON response
+func doRequest(httpClient *http.Client, req *http.Request, username string, password string) (map[string]interface{}, error) {
 
 	// before the request is send set the HTTP Header key "Authorization" with
 	// the value of base64 encoded Username and Password
@@ -77,72 +123,194 @@ func main() {
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	// Status Code 401 Unauthorized means user+password was not valid
+	if resp.StatusCode == 401 {
+		return nil, errors.New("username or password not valid")
+	}
+
 	// read the data from the resp.body into bodyText
 	bodyText, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, bodyText)
 	}
 
 	// create interface
 	var f interface{}
-	var uuid string
 
 	// Unmarshal into interface f
-	if err2 := json.Unmarshal(bodyText, &f); err != nil {
-		panic(err2)
+	if err := json.Unmarshal(bodyText, &f); err != nil {
+		return nil, err
 	}
 
 	// type assertion to access f´s underlying map[string]interface
-	m := f.(map[string]interface{})
+	m, ok := f.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("unexpected response from " + req.URL.Path)
+	}
+
+	return m, nil
+}
+
+// categoryUUIDs returns the UUIDs of all VMs which have the category key:value
+// assigned. Categories are only available with the v3 API.
+func categoryUUIDs(httpClient *http.Client, NutanixHost string, username string, password string, category string) (map[string]bool, error) {
+
+	kv := strings.SplitN(category, ":", 2)
+	uuids := make(map[string]bool)
+
+	// the v3 API is using POST with a JSON body to list entities page by page
+	for offset := 0; ; {
+		body := []byte(fmt.Sprintf(`{"kind":"vm","length":500,"offset":%d}`, offset))
+		req, _ := http.NewRequest("POST", v3_0(NutanixHost)+"vms/list", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		m, err := doRequest(httpClient, req, username, password)
+		if err != nil {
+			return nil, err
+		}
+
+		e, _ := m["entities"].([]interface{})
+		for k := range e {
+			t, _ := e[k].(map[string]interface{})
+			md, _ := t["metadata"].(map[string]interface{})
+			c, _ := md["categories"].(map[string]interface{})
+			uuid, ok := md["uuid"].(string)
+			if !ok {
+				return nil, errors.New("VM without uuid in " + req.URL.Path)
+			}
+
+			if c[kv[0]] == kv[1] {
+				uuids[uuid] = true
+			}
+		}
+
+		// total_matches is a JSON number and unmarshalled as float64
+		md, _ := m["metadata"].(map[string]interface{})
+		total, _ := md["total_matches"].(float64)
+		offset += len(e)
+		if len(e) == 0 || offset >= int(total) {
+			return uuids, nil
+		}
+	}
+}
+
+// selectVMs returns the UUIDs of all VMs matching the selector. It fails if no
+// VM matches or if several VMs match and the selector does not allow all.
+func selectVMs(httpClient *http.Client, NutanixHost string, username string, password string, s vmSelector) ([]string, error) {
+
+	var re *regexp.Regexp
+	if s.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(s.Regex); err != nil {
+			return nil, err
+		}
+	}
+
+	var inCategory map[string]bool
+	if s.Category != "" {
+		var err error
+		if inCategory, err = categoryUUIDs(httpClient, NutanixHost, username, password, s.Category); err != nil {
+			return nil, err
+		}
+	}
+
+	// send a GET to the NUTANIX API and receives the list of all VMs
+	req, _ := http.NewRequest("GET", v2_0(NutanixHost)+"/vms", nil)
+
+	m, err := doRequest(httpClient, req, username, password)
+	if err != nil {
+		return nil, err
+	}
 
 	// the response will include entities which includes the data of the VMs we searching for
-	e := m["entities"].([]interface{})
+	e, _ := m["entities"].([]interface{})
+
+	var uuids, names []string
 
-	// we can iterate through the map and search for the name of the VM
+	// we can iterate through the map and search for the VMs matching the selector
 	for k := range e {
-		t := e[k].(map[string]interface{})
+		t, _ := e[k].(map[string]interface{})
+		uuid, _ := t["uuid"].(string)
 
-		if t["name"] == "docker-mac" {
-			uuid = t["uuid"].(string)
+		if inCategory != nil && inCategory[uuid] || inCategory == nil && s.matches(t, re) {
+			uuids = append(uuids, uuid)
+			names = append(names, fmt.Sprintf("%v (%s)", t["name"], uuid))
 		}
 	}
 
-	// Defines the HTTP Request
-	// send a GET to the NUTANIX API and receives the details of VM "docker-mac"
+	if len(uuids) == 0 {
+		return nil, errors.New("no VM found for " + s.describe())
+	}
 
-	req, _ = http.NewRequest("GET", v2_0(NutanixHost)+"/vms/"+uuid, nil)
+	if len(uuids) > 1 && !s.All {
+		return nil, fmt.Errorf("%d VMs found for %s, use -all to select all of them:\n  %s",
+			len(uuids), s.describe(), strings.Join(names, "\n  "))
+	}
 
-	// before the request is send set the HTTP Header key "Authorization" with
-	// the value of base64 encoded Username and Password
-	req.Header.Set("Authorization", "Basic "+EncodeCredentials(username, password))
+	return uuids, nil
+}
 
-	resp, err = httpClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+func main() {
+
+	// the VM selection is read from the command line
+	var s vmSelector
+	flag.StringVar(&s.Name, "name", "", "exact name of the VM")
+	flag.StringVar(&s.Glob, "glob", "", "glob pattern matching the VM name, e.g. docker-*")
+	flag.StringVar(&s.Regex, "regex", "", "regular expression matching the VM name")
+	flag.StringVar(&s.UUID, "uuid", "", "UUID or UUID prefix of the VM")
+	flag.StringVar(&s.Category, "category", "", "v3 category of the VM as key:value")
+	flag.BoolVar(&s.All, "all", false, "operate on all matching VMs instead of failing if several match")
+	flag.Parse()
+
+	if err := s.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer resp.Body.Close()
 
-	// read the data from the resp.body into bodyText
-	bodyText, err = ioutil.ReadAll(resp.Body)
+	// PRISM user
+	var username = "admin"
+	// PRISM user password
+	var password = "nutanix/4u"
+	// Nutanix Cluster IP/DNSName CVM IP/DNSName
+	var NutanixHost = "192.168.178.130"
+
+	// Ignores certificates which can not be validated
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	// create a HTTP client
+	var httpClient = &http.Client{Transport: tr}
+
+	// receives the UUIDs of the VMs matching the selection
+	uuids, err := selectVMs(httpClient, NutanixHost, username, password, s)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Unmarshal into interface f
-	if err2 := json.Unmarshal(bodyText, &f); err != nil {
-		panic(err2)
-	}
+	for _, uuid := range uuids {
 
-	m = f.(map[string]interface{})
+		// Defines the HTTP Request
+		// send a GET to the NUTANIX API and receives the details of the VM
+		req, _ := http.NewRequest("GET", v2_0(NutanixHost)+"/vms/"+uuid, nil)
 
-	fmt.Println(m["name"])
-	fmt.Println(m["memory_mb"])
-	fmt.Println(m["num_vcpus"])
+		m, err := doRequest(httpClient, req, username, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(m["name"])
+		fmt.Println(m["memory_mb"])
+		fmt.Println(m["num_vcpus"])
+	}
 
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// vmsGetV2 is the part of the v2 /vms response including the NIC config
+type vmsGetV2 struct {
+	Entities []struct {
+		UUID       string `json:"uuid"`
+		Name       string `json:"name"`
+		PowerState string `json:"power_state"`
+		HostUUID   string `json:"host_uuid"`
+		VMNics     []struct {
+			MacAddress         string `json:"mac_address"`
+			RequestedIPAddress string `json:"requested_ip_address"`
+		} `json:"vm_nics"`
+	} `json:"entities"`
+}
+
+// vmsGetV1 is the part of the v1 /vms response including the guest reported IPs
+type vmsGetV1 struct {
+	Entities []struct {
+		UUID        string   `json:"uuid"`
+		IPAddresses []string `json:"ipAddresses"`
+	} `json:"entities"`
+}
+
+// hostsGetV2 is the part of the v2 /hosts response to resolve host names
+type hostsGetV2 struct {
+	Entities []struct {
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	} `json:"entities"`
+}
+
+// vmsListV3 is the part of the v3 /vms/list response including the categories
+type vmsListV3 struct {
+	Metadata struct {
+		TotalMatches int `json:"total_matches"`
+	} `json:"metadata"`
+	Entities []struct {
+		Metadata struct {
+			UUID       string            `json:"uuid"`
+			Categories map[string]string `json:"categories"`
+		} `json:"metadata"`
+	} `json:"entities"`
+}
+
+// group is an Ansible inventory group
+type group struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// inventory is the complete Ansible dynamic inventory as returned by --list
+type inventory struct {
+	Groups   map[string]*group
+	HostVars map[string]map[string]interface{}
+}
+
+// MarshalJSON writes the groups at top level and the host variables into _meta
+// so Ansible does not need to call --host for every VM
+func (inv inventory) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{})
+	for name, g := range inv.Groups {
+		out[name] = g
+	}
+	out["_meta"] = map[string]interface{}{"hostvars": inv.HostVars}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads an inventory written by MarshalJSON from the cache
+func (inv *inventory) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	inv.Groups = make(map[string]*group)
+	inv.HostVars = make(map[string]map[string]interface{})
+
+	for name, v := range raw {
+		if name == "_meta" {
+			var meta struct {
+				HostVars map[string]map[string]interface{} `json:"hostvars"`
+			}
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			inv.HostVars = meta.HostVars
+			continue
+		}
+		g := &group{}
+		if err := json.Unmarshal(v, g); err != nil {
+			return err
+		}
+		inv.Groups[name] = g
+	}
+	return nil
+}
+
+// addHost adds the host to the group and creates the group as child of all
+func (inv *inventory) addHost(groupName string, host string) {
+	groupName = groupNameRe.ReplaceAllString(groupName, "_")
+
+	g, ok := inv.Groups[groupName]
+	if !ok {
+		g = &group{}
+		inv.Groups[groupName] = g
+		inv.Groups["all"].Children = append(inv.Groups["all"].Children, groupName)
+	}
+	g.Hosts = append(g.Hosts, host)
+}
+
+// groupNameRe matches all characters Ansible does not allow in group names
+var groupNameRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// EncodeCredentials this func is encoding the Username and Password with base64 encoding which is
+// required for Nutanix
+func EncodeCredentials(username string, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// v1_0 returns the main entry point for the v1.0 Nutanix API
+func v1_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/PrismGateway/services/rest/v1/"
+
+}
+
+// v2_0 returns the main entry point for the v2.0 Nutanix API
+func v2_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/PrismGateway/services/rest/v2.0/"
+
+}
+
+// v3_0 returns the main entry point for the v3.0 Nutanix API
+func v3_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/api/nutanix/v3/"
+
+}
+
+// getenv returns the value of the environment variable key or def if not set
+func getenv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// doJSON sends the request with the body and unmarshals the response into v
+func doJSON(httpClient *http.Client, method string, url string, body []byte, username string, password string, v interface{}) error {
+
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// before the request is send set the HTTP Header key "Authorization" with
+	// the value of base64 encoded Username and Password
+	req.Header.Set("Authorization", "Basic "+EncodeCredentials(username, password))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// read the data from the resp.body into bodyText
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+
+	return json.Unmarshal(bodyText, v)
+}
+
+// vmCategories returns the categories of all VMs by VM UUID. The v3 API is
+// using POST with a JSON body to list entities page by page.
+func vmCategories(httpClient *http.Client, NutanixHost string, username string, password string) (map[string]map[string]string, error) {
+
+	categories := make(map[string]map[string]string)
+	for offset := 0; ; {
+		var v3 vmsListV3
+		body := []byte(fmt.Sprintf(`{"kind":"vm","length":500,"offset":%d}`, offset))
+		if err := doJSON(httpClient, "POST", v3_0(NutanixHost)+"vms/list", body, username, password, &v3); err != nil {
+			return nil, err
+		}
+
+		for _, vm := range v3.Entities {
+			categories[vm.Metadata.UUID] = vm.Metadata.Categories
+		}
+
+		offset += len(v3.Entities)
+		if len(v3.Entities) == 0 || offset >= v3.Metadata.TotalMatches {
+			return categories, nil
+		}
+	}
+}
+
+// buildInventory receives the VMs, IPs, hosts and categories from the cluster
+// and groups the VMs by power state, host and category
+func buildInventory(httpClient *http.Client, NutanixHost string, username string, password string) (*inventory, error) {
+
+	var v2 vmsGetV2
+	if err := doJSON(httpClient, "GET", v2_0(NutanixHost)+"/vms/?include_vm_nic_config=true", nil, username, password, &v2); err != nil {
+		return nil, err
+	}
+
+	// the v2 API does not return the IPs reported by the guest
+	var v1 vmsGetV1
+	if err := doJSON(httpClient, "GET", v1_0(NutanixHost)+"/vms/", nil, username, password, &v1); err != nil {
+		return nil, err
+	}
+
+	var hosts hostsGetV2
+	if err := doJSON(httpClient, "GET", v2_0(NutanixHost)+"/hosts/", nil, username, password, &hosts); err != nil {
+		return nil, err
+	}
+
+	// categories are only available with the v3 API, older clusters are
+	// inventoried without category groups
+	categories, err := vmCategories(httpClient, NutanixHost, username, password)
+	if err != nil {
+		log.Println("categories not available:", err)
+	}
+
+	guestIPs := make(map[string][]string)
+	for _, vm := range v1.Entities {
+		guestIPs[vm.UUID] = vm.IPAddresses
+	}
+
+	hostNames := make(map[string]string)
+	for _, h := range hosts.Entities {
+		hostNames[h.UUID] = h.Name
+	}
+
+	// VM names are not unique, duplicates get the start of the UUID appended
+	// so they do not overwrite each other
+	names := make(map[string]int)
+	for _, vm := range v2.Entities {
+		names[vm.Name]++
+	}
+
+	inv := &inventory{
+		Groups:   map[string]*group{"all": {}},
+		HostVars: make(map[string]map[string]interface{}),
+	}
+
+	for _, vm := range v2.Entities {
+
+		// the guest reported IPs are preferred, the AHV managed IPs are used
+		// if no guest tools are reporting
+		var ips []string
+		ips = append(ips, guestIPs[vm.UUID]...)
+		for _, nic := range vm.VMNics {
+			if nic.RequestedIPAddress != "" {
+				ips = append(ips, nic.RequestedIPAddress)
+			}
+		}
+
+		vars := map[string]interface{}{
+			"nutanix_name":        vm.Name,
+			"nutanix_uuid":        vm.UUID,
+			"nutanix_power_state": vm.PowerState,
+			"nutanix_host":        hostNames[vm.HostUUID],
+			"nutanix_ips":         ips,
+			"nutanix_categories":  categories[vm.UUID],
+		}
+
+		for _, ip := range ips {
+			if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+				vars["ansible_host"] = ip
+				break
+			}
+		}
+
+		name := vm.Name
+		if names[vm.Name] > 1 {
+			name = vm.Name + "_" + strings.SplitN(vm.UUID, "-", 2)[0]
+			log.Printf("VM name %s is not unique, using %s", vm.Name, name)
+		}
+		inv.HostVars[name] = vars
+
+		inv.addHost("power_"+strings.ToLower(vm.PowerState), name)
+		if hostName := hostNames[vm.HostUUID]; hostName != "" {
+			inv.addHost("host_"+hostName, name)
+		}
+		for key, value := range categories[vm.UUID] {
+			inv.addHost("category_"+key+"_"+value, name)
+		}
+	}
+
+	for _, g := range inv.Groups {
+		sort.Strings(g.Hosts)
+		sort.Strings(g.Children)
+	}
+
+	return inv, nil
+}
+
+// cachedInventory returns the inventory from the cache file if it is younger
+// than ttl, otherwise the inventory is build and written to the cache
+func cachedInventory(httpClient *http.Client, NutanixHost string, username string, password string, cacheFile string, ttl time.Duration) (*inventory, error) {
+
+	if fi, err := os.Stat(cacheFile); err == nil && time.Since(fi.ModTime()) < ttl {
+		if data, err := ioutil.ReadFile(cacheFile); err == nil {
+			inv := &inventory{}
+			if err := json.Unmarshal(data, inv); err == nil {
+				return inv, nil
+			}
+		}
+	}
+
+	inv, err := buildInventory(httpClient, NutanixHost, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	// a failing cache is not fatal, the next run will fetch the data again
+	if err := ioutil.WriteFile(cacheFile, data, 0600); err != nil {
+		log.Println("writing cache failed:", err)
+	}
+
+	return inv, nil
+}
+
+func main() {
+
+	// Ansible calls dynamic inventory scripts with --list or --host <name>
+	var list = flag.Bool("list", false, "print the complete inventory")
+	var host = flag.String("host", "", "print the variables of a single VM")
+	var refresh = flag.Bool("refresh", false, "ignore the cache and receive the inventory from the cluster")
+	var ttl = flag.Duration("cache-ttl", 5*time.Minute, "time the cached inventory is used")
+	flag.Parse()
+
+	if !*list && *host == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Ansible does not pass arguments to the script, so the connection is
+	// configured by environment variables
+	// PRISM user
+	var username = getenv("NUTANIX_USERNAME", "admin")
+	// PRISM user password
+	var password = getenv("NUTANIX_PASSWORD", "nutanix/4u")
+	// Nutanix Cluster IP/DNSName CVM IP/DNSName
+	var NutanixHost = getenv("NUTANIX_HOST", "192.168.178.130")
+
+	// Ignores certificates which can not be validated
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	// create a HTTP client
+	var httpClient = &http.Client{Transport: tr, Timeout: 60 * time.Second}
+
+	cacheFile := filepath.Join(os.TempDir(), "nutanix-inventory-"+NutanixHost+".json")
+	if *refresh {
+		os.Remove(cacheFile)
+	}
+
+	inv, err := cachedInventory(httpClient, NutanixHost, username, password, cacheFile, *ttl)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	var out interface{} = inv
+	if *host != "" {
+		vars, ok := inv.HostVars[*host]
+		if !ok {
+			vars = map[string]interface{}{}
+		}
+		out = vars
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(string(data))
+
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// alert is an alert as returned by the v2 /alerts API
+type alert struct {
+	ID                             string   `json:"id"`
+	AlertTypeUUID                  string   `json:"alert_type_uuid"`
+	CheckID                        string   `json:"check_id"`
+	ClusterUUID                    string   `json:"cluster_uuid"`
+	Severity                       string   `json:"severity"`
+	AlertTitle                     string   `json:"alert_title"`
+	Message                        string   `json:"message"`
+	ContextTypes                   []string `json:"context_types"`
+	ContextValues                  []string `json:"context_values"`
+	Resolved                       bool     `json:"resolved"`
+	Acknowledged                   bool     `json:"acknowledged"`
+	CreatedTimeStampInUsecs        int64    `json:"created_time_stamp_in_usecs"`
+	LastOccurrenceTimeStampInUsecs int64    `json:"last_occurrence_time_stamp_in_usecs"`
+	ResolvedTimeStampInUsecs       int64    `json:"resolved_time_stamp_in_usecs"`
+}
+
+// severity returns the severity without the "k" prefix of the API like
+// "critical"
+func (a alert) severity() string {
+	return strings.ToLower(strings.TrimPrefix(a.Severity, "k"))
+}
+
+// text returns the message with the {placeholders} replaced by the context
+// values of the alert
+func (a alert) text() string {
+	msg := a.Message
+	for i, name := range a.ContextTypes {
+		if i < len(a.ContextValues) {
+			msg = strings.Replace(msg, "{"+name+"}", a.ContextValues[i], -1)
+		}
+	}
+	return msg
+}
+
+// title returns the title with the {placeholders} replaced
+func (a alert) title() string {
+	return alert{Message: a.AlertTitle, ContextTypes: a.ContextTypes, ContextValues: a.ContextValues}.text()
+}
+
+// alertsPageSize is the number of alerts requested per page
+const alertsPageSize = 500
+
+// listAlerts returns all resolved or unresolved alerts page by page
+func (c *client) listAlerts(resolved bool) ([]alert, error) {
+	var all []alert
+	for page := 1; ; page++ {
+		var resp struct {
+			Metadata struct {
+				TotalEntities int `json:"total_entities"`
+			} `json:"metadata"`
+			Entities []alert `json:"entities"`
+		}
+		path := fmt.Sprintf("/alerts/?resolved=%t&count=%d&page=%d", resolved, alertsPageSize, page)
+		if err := c.get(c.v2(path), &resp); err != nil {
+			return nil, err
+		}
+		all = append(all, resp.Entities...)
+		if len(resp.Entities) < alertsPageSize || len(all) >= resp.Metadata.TotalEntities {
+			return all, nil
+		}
+	}
+}
+
+// getAlert returns a single alert
+func (c *client) getAlert(uuid string) (alert, error) {
+	var a alert
+	err := c.get(c.v2("/alerts/"+uuid), &a)
+	return a, err
+}
+
+// severityLevels orders the severities for -severity
+var severityLevels = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// alertEvent is a new or resolved alert as it is forwarded
+type alertEvent struct {
+	Event    string     `json:"event"` // new or resolved
+	UUID     string     `json:"uuid"`
+	Title    string     `json:"title"`
+	Message  string     `json:"message"`
+	Severity string     `json:"severity"`
+	Cluster  string     `json:"cluster"`
+	Prism    string     `json:"prism"`
+	Created  time.Time  `json:"created"`
+	Resolved *time.Time `json:"resolved,omitempty"`
+}
+
+// newAlertEvent returns the event of the alert
+func newAlertEvent(event string, a alert, cluster string, prism string) alertEvent {
+	e := alertEvent{
+		Event:    event,
+		UUID:     a.ID,
+		Title:    a.title(),
+		Message:  a.text(),
+		Severity: a.severity(),
+		Cluster:  cluster,
+		Prism:    prism,
+		Created:  time.Unix(0, a.CreatedTimeStampInUsecs*1000).UTC(),
+	}
+	if a.ResolvedTimeStampInUsecs > 0 {
+		t := time.Unix(0, a.ResolvedTimeStampInUsecs*1000).UTC()
+		e.Resolved = &t
+	}
+	return e
+}
+
+// webhookTemplates are the built-in payloads of the webhooks. The json
+// function quotes a value as JSON string.
+var webhookTemplates = map[string]string{
+	"slack": `{"text": {{json (printf "[%s] %s: %s on %s\n%s" .Event .Severity .Title .Cluster .Message)}}}`,
+	"teams": `{"@type": "MessageCard", "@context": "https://schema.org/extensions",
+ "themeColor": "{{if eq .Event "resolved"}}2EB886{{else if eq .Severity "critical"}}D50000{{else}}FFA000{{end}}",
+ "summary": {{json .Title}},
+ "title": {{json (printf "[%s] %s: %s" .Event .Severity .Title)}},
+ "text": {{json (printf "%s<br>Cluster: %s" .Message .Cluster)}}}`,
+}
+
+// templateFuncs are the functions available in the webhook templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// webhook is an HTTP endpoint the events are posted to. A nil template
+// posts the event as JSON.
+type webhook struct {
+	url  string
+	tmpl *template.Template
+}
+
+// parseWebhook parses "[json|slack|teams|template-file=]url"
+func parseWebhook(s string) (webhook, error) {
+	format, url := "json", s
+	if i := strings.Index(s, "="); i > 0 && !strings.Contains(s[:i], "://") {
+		format, url = s[:i], s[i+1:]
+	}
+
+	w := webhook{url: url}
+	text, ok := webhookTemplates[format]
+	switch {
+	case format == "json":
+		return w, nil
+	case !ok:
+		// a template file for other payloads
+		data, err := ioutil.ReadFile(format)
+		if err != nil {
+			return w, fmt.Errorf("webhook %s: unknown format or template file: %v", url, err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New(format).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return w, err
+	}
+	w.tmpl = tmpl
+	return w, nil
+}
+
+// send posts the event
+func (w webhook) send(e alertEvent) error {
+	var body bytes.Buffer
+	if w.tmpl == nil {
+		json.NewEncoder(&body).Encode(e)
+	} else if err := w.tmpl.Execute(&body, e); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(w.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s returned %s: %s", w.url, resp.Status, msg)
+	}
+	return nil
+}
+
+// syslogFacility is local0, the facility of all forwarded alerts
+const syslogFacility = 16
+
+// syslogSeverity maps the alert severity to the syslog severity
+var syslogSeverity = map[string]int{"critical": 2, "warning": 4, "info": 6}
+
+// syslogMessage returns the event as RFC 5424 message. Resolved alerts are
+// sent with severity notice. 32473 is the enterprise number reserved for
+// documentation.
+func syslogMessage(e alertEvent, hostname string) string {
+	sev, ok := syslogSeverity[e.Severity]
+	if !ok {
+		sev = 6
+	}
+	if e.Event == "resolved" {
+		sev = 5
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "]", `\]`)
+	sd := fmt.Sprintf(`[alert@32473 event="%s" uuid="%s" severity="%s" cluster="%s" prism="%s"]`,
+		e.Event, e.UUID, e.Severity, escape.Replace(e.Cluster), escape.Replace(e.Prism))
+	return fmt.Sprintf("<%d>1 %s %s ntnx %d %s %s %s: %s",
+		syslogFacility*8+sev, time.Now().UTC().Format(time.RFC3339), hostname, os.Getpid(),
+		strings.ToUpper(e.Event), sd, e.Title, e.Message)
+}
+
+// syslogTarget sends the events to a syslog server over UDP or TCP. TCP
+// messages are framed by octet counting (RFC 6587).
+type syslogTarget struct {
+	w        *sinkWriter
+	tcp      bool
+	hostname string
+}
+
+// send writes the event
+func (s *syslogTarget) send(e alertEvent) error {
+	msg := syslogMessage(e, s.hostname)
+	if s.tcp {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	_, err := s.w.Write([]byte(msg))
+	return err
+}
+
+// alertState is persisted between runs. Open holds the forwarded alerts
+// which are not resolved yet.
+type alertState struct {
+	Open map[string]alertEvent `json:"open"`
+}
+
+// loadAlertState reads the state, a missing file is an empty state
+func loadAlertState(file string) (*alertState, error) {
+	s := &alertState{Open: make(map[string]alertEvent)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if s.Open == nil {
+		s.Open = make(map[string]alertEvent)
+	}
+	return s, nil
+}
+
+// save writes the state atomically so an interrupted daemon does not leave
+// a broken file
+func (s *alertState) save(file string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// alertForwarder polls the alerts and forwards new and resolved ones
+type alertForwarder struct {
+	c           *client
+	state       *alertState
+	minSeverity int
+	forward     []func(alertEvent) error
+}
+
+// send forwards the event to all targets
+func (f *alertForwarder) send(e alertEvent) error {
+	var errs []error
+	for _, fn := range f.forward {
+		if err := fn(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+// poll forwards the alerts raised and resolved since the last poll. Alerts
+// which could not be forwarded are tried again with the next poll.
+func (f *alertForwarder) poll() error {
+
+	var errs []error
+	for _, cc := range f.c.all() {
+		clusters, err := cc.listClusters()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		names := make(map[string]string)
+		for _, ci := range clusters {
+			names[ci.UUID] = ci.Name
+		}
+		clusterName := func(uuid string) string {
+			if name, ok := names[uuid]; ok || len(clusters) != 1 {
+				return name
+			}
+			return clusters[0].Name
+		}
+
+		open, err := cc.listAlerts(false)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		current := make(map[string]bool)
+		for _, a := range open {
+			current[a.ID] = true
+			if _, sent := f.state.Open[a.ID]; sent || severityLevels[a.severity()] < f.minSeverity {
+				continue
+			}
+			e := newAlertEvent("new", a, clusterName(a.ClusterUUID), cc.host)
+			if err := f.send(e); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			f.state.Open[a.ID] = e
+		}
+
+		// forwarded alerts which are not listed as open anymore are resolved
+		// if the alert says so or it was deleted
+		for id, e := range f.state.Open {
+			if e.Prism != cc.host || current[id] {
+				continue
+			}
+			a, err := cc.getAlert(id)
+			if apiErr, ok := err.(*apiError); ok && apiErr.StatusCode == http.StatusNotFound {
+				a, err = alert{ID: id, AlertTitle: e.Title, Message: e.Message, Severity: e.Severity, Resolved: true, ResolvedTimeStampInUsecs: time.Now().UnixNano() / 1000}, nil
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !a.Resolved {
+				continue
+			}
+			resolved := newAlertEvent("resolved", a, e.Cluster, cc.host)
+			resolved.Created = e.Created
+			if err := f.send(resolved); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			delete(f.state.Open, id)
+		}
+	}
+	return joinErrors(errs)
+}
+
+// stringList is a flag which can be given several times
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// runAlertsForward is the "alerts forward" command
+func runAlertsForward(c *client, args []string) error {
+
+	var webhooks, syslogs stringList
+	fs := flag.NewFlagSet("alerts forward", flag.ExitOnError)
+	fs.Var(&webhooks, "webhook", "`[format=]url` to post the alerts to, format is json (default), slack, teams or a template file; repeatable")
+	fs.Var(&syslogs, "syslog", "udp://host:port or tcp://host:port of a syslog server; repeatable")
+	var interval = fs.Duration("interval", 30*time.Second, "poll interval")
+	var once = fs.Bool("once", false, "poll once and exit")
+	var severity = fs.String("severity", "info", "minimum severity to forward: info, warning or critical")
+	var stateFile = fs.String("state", defaultHistoryFile(".ntnx-alerts.json"), "file the forwarded alerts are persisted in")
+	fs.Parse(args)
+
+	if len(webhooks) == 0 && len(syslogs) == 0 {
+		return errors.New("at least one -webhook or -syslog is required")
+	}
+	minSeverity, ok := severityLevels[*severity]
+	if !ok {
+		return fmt.Errorf("unknown severity %q", *severity)
+	}
+	if *interval <= 0 && !*once {
+		return errors.New("-interval has to be positive unless -once is set")
+	}
+
+	state, err := loadAlertState(*stateFile)
+	if err != nil {
+		return err
+	}
+	f := &alertForwarder{c: c, state: state, minSeverity: minSeverity}
+
+	for _, s := range webhooks {
+		w, err := parseWebhook(s)
+		if err != nil {
+			return err
+		}
+		f.forward = append(f.forward, w.send)
+	}
+	hostname, _ := os.Hostname()
+	for _, s := range syslogs {
+		if !strings.HasPrefix(s, "udp://") && !strings.HasPrefix(s, "tcp://") {
+			return fmt.Errorf("syslog %s: use udp://host:port or tcp://host:port", s)
+		}
+		w, err := newSinkWriter(s)
+		if err != nil {
+			return err
+		}
+		t := &syslogTarget{w: w, tcp: strings.HasPrefix(s, "tcp://"), hostname: hostname}
+		f.forward = append(f.forward, t.send)
+	}
+
+	poll := func() error {
+		err := f.poll()
+		if saveErr := state.save(*stateFile); saveErr != nil {
+			return saveErr
+		}
+		return err
+	}
+
+	if *once {
+		return poll()
+	}
+
+	if err := poll(); err != nil {
+		log.Print(err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := poll(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func init() {
+	register(command{name: "alerts forward", usage: "forward new and resolved alerts to webhooks and syslog", run: runAlertsForward})
+}
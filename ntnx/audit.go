@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// clusterBaseline describes the standard cluster settings. Settings which are
+// not set in the baseline file are not audited.
+//
+//	name_servers: [10.0.0.10, 10.0.0.11]
+//	ntp_servers: [0.pool.ntp.org, 1.pool.ntp.org]
+//	timezone: UTC
+//	enable_lock_down: false
+//	enable_shadow_clones: true
+//	global_nfs_white_list: []
+//	http_proxies: [proxy.example.com:8080]
+//	smtp_server:
+//	  address: smtp.example.com
+//	  port: 25
+type clusterBaseline struct {
+	NameServers        *[]string              `json:"name_servers"`
+	NtpServers         *[]string              `json:"ntp_servers"`
+	Timezone           *string                `json:"timezone"`
+	EnableLockDown     *bool                  `json:"enable_lock_down"`
+	EnableShadowClones *bool                  `json:"enable_shadow_clones"`
+	GlobalNfsWhiteList *[]string              `json:"global_nfs_white_list"`
+	HTTPProxies        *[]string              `json:"http_proxies"`
+	SMTPServer         map[string]interface{} `json:"smtp_server"`
+}
+
+// drift is a single setting of a cluster which differs from the baseline
+type drift struct {
+	Cluster  string `json:"cluster"`
+	Setting  string `json:"setting"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// sameSet returns true if both lists have the same entries in any order
+func sameSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyAddresses returns the HTTP proxies of the cluster as address:port
+func proxyAddresses(proxies []interface{}) []string {
+	var out []string
+	for _, p := range proxies {
+		m, _ := p.(map[string]interface{})
+		out = append(out, fmt.Sprintf("%v:%v", m["address"], m["port"]))
+	}
+	return out
+}
+
+// audit compares the cluster with the baseline and returns all drifted settings
+func (b clusterBaseline) audit(ci clusterInfo) []drift {
+
+	var drifts []drift
+	add := func(setting string, expected interface{}, actual interface{}) {
+		drifts = append(drifts, drift{Cluster: ci.Name, Setting: setting,
+			Expected: fmt.Sprint(expected), Actual: fmt.Sprint(actual)})
+	}
+
+	if b.NameServers != nil && !sameSet(*b.NameServers, ci.NameServers) {
+		add("name_servers", *b.NameServers, ci.NameServers)
+	}
+	if b.NtpServers != nil && !sameSet(*b.NtpServers, ci.NtpServers) {
+		add("ntp_servers", *b.NtpServers, ci.NtpServers)
+	}
+	if b.Timezone != nil && *b.Timezone != ci.Timezone {
+		add("timezone", *b.Timezone, ci.Timezone)
+	}
+	if b.EnableLockDown != nil && *b.EnableLockDown != ci.EnableLockDown {
+		add("enable_lock_down", *b.EnableLockDown, ci.EnableLockDown)
+	}
+	if b.EnableShadowClones != nil && *b.EnableShadowClones != ci.EnableShadowClones {
+		add("enable_shadow_clones", *b.EnableShadowClones, ci.EnableShadowClones)
+	}
+	if b.GlobalNfsWhiteList != nil && !sameSet(*b.GlobalNfsWhiteList, ci.GlobalNfsWhiteList) {
+		add("global_nfs_white_list", *b.GlobalNfsWhiteList, ci.GlobalNfsWhiteList)
+	}
+	if b.HTTPProxies != nil {
+		if actual := proxyAddresses(ci.HTTPProxies); !sameSet(*b.HTTPProxies, actual) {
+			add("http_proxies", *b.HTTPProxies, actual)
+		}
+	}
+
+	// only the SMTP fields given in the baseline are compared
+	if b.SMTPServer != nil {
+		actual, _ := ci.SMTPServer.(map[string]interface{})
+		var keys []string
+		for k := range b.SMTPServer {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			expected := fmt.Sprint(b.SMTPServer[k])
+			if actual == nil {
+				add("smtp_server."+k, expected, "<not configured>")
+			} else if got := fmt.Sprint(actual[k]); got != expected {
+				add("smtp_server."+k, expected, got)
+			}
+		}
+	}
+
+	return drifts
+}
+
+// runClusterAudit is the "cluster audit" command
+func runClusterAudit(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster audit", flag.ExitOnError)
+	var file = fs.String("baseline", "", "baseline file with the standard cluster settings (YAML or JSON)")
+	var jsonOut = fs.Bool("json", false, "print the drifted settings as JSON")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-baseline is required")
+	}
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	var b clusterBaseline
+	if err := decodeSpec(*file, data, &b); err != nil {
+		return err
+	}
+
+	clusters, err := c.listAllClusters()
+	if err != nil {
+		return err
+	}
+
+	drifts := []drift{}
+	perCluster := make([][]drift, len(clusters))
+	numDrifted := 0
+	for i, ci := range clusters {
+		perCluster[i] = b.audit(ci)
+		if len(perCluster[i]) > 0 {
+			numDrifted++
+		}
+		drifts = append(drifts, perCluster[i]...)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(drifts)
+	} else {
+		for i, ci := range clusters {
+			if len(perCluster[i]) == 0 {
+				fmt.Printf("%s: compliant\n", ci.Name)
+				continue
+			}
+			fmt.Printf("%s: drifted\n", ci.Name)
+			for _, d := range perCluster[i] {
+				fmt.Printf("  %-24s expected %s, actual %s\n", d.Setting, d.Expected, d.Actual)
+			}
+		}
+	}
+
+	// a drift fails the command, so it can be used as CI check
+	if len(drifts) > 0 {
+		return fmt.Errorf("%d settings drifted on %d of %d clusters", len(drifts), numDrifted, len(clusters))
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "cluster audit", usage: "compare the cluster settings with a baseline file", run: runClusterAudit})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// skipError is returned by a bulk action if the VM needs no change
+type skipError string
+
+func (e skipError) Error() string { return string(e) }
+
+// bulkAction is run for every VM selected by "vm bulk"
+type bulkAction func(v vm) (string, error)
+
+// bulkResult is the result of the action on a single VM
+type bulkResult struct {
+	VM       string  `json:"vm"`
+	UUID     string  `json:"uuid"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// bulkSummary counts the results by status
+type bulkSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+}
+
+// runBulk runs the action on all VMs with at most parallel actions at the
+// same time and at most rate actions started per second (0 is unlimited).
+// Errors do not stop the other VMs.
+func runBulk(vms []vm, parallel int, rate float64, action bulkAction, progress func(bulkResult)) []bulkResult {
+
+	results := make([]bulkResult, len(vms))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				v := vms[i]
+				start := time.Now()
+				msg, err := action(v)
+
+				res := bulkResult{VM: v.Name, UUID: v.UUID, Status: "success", Message: msg,
+					Duration: time.Since(start).Seconds()}
+				if _, ok := err.(skipError); ok {
+					res.Status, res.Message = "skipped", err.Error()
+				} else if err != nil {
+					res.Status, res.Message = "failed", err.Error()
+				}
+				results[i] = res
+
+				if progress != nil {
+					mu.Lock()
+					progress(res)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := range vms {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// summarize counts the results by status
+func summarize(results []bulkResult) bulkSummary {
+	s := bulkSummary{Total: len(results)}
+	for _, r := range results {
+		switch r.Status {
+		case "success":
+			s.Succeeded++
+		case "failed":
+			s.Failed++
+		case "skipped":
+			s.Skipped++
+		}
+	}
+	return s
+}
+
+// bulkFilter selects the VMs of "vm bulk". Without a selector all VMs are
+// selected, destructive actions require all to be set then.
+type bulkFilter struct {
+	selector   vmSelector
+	powerState string
+	host       string
+	expr       string
+	all        bool
+}
+
+// addFlags registers the filter flags on fs
+func (f *bulkFilter) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.selector.Name, "name", "", "exact name of the VMs")
+	fs.StringVar(&f.selector.Glob, "glob", "", "glob pattern matching the VM names, e.g. ci-*")
+	fs.StringVar(&f.selector.Regex, "regex", "", "regular expression matching the VM names")
+	fs.StringVar(&f.selector.UUID, "uuid", "", "UUID prefix of the VMs")
+	fs.StringVar(&f.selector.Category, "category", "", "v3 category of the VMs as key:value")
+	fs.StringVar(&f.powerState, "power-state", "", "only VMs in this power state, e.g. on")
+	fs.StringVar(&f.host, "on-host", "", "only VMs running on the host with this name")
+	fs.StringVar(&f.expr, "filter", "", "filter expression, e.g. power_state==on;name=~^ci-")
+	fs.BoolVar(&f.all, "all", false, "select all VMs of the cluster, required for destructive actions without a selector")
+}
+
+// selective returns true if any selector or filter is set
+func (f bulkFilter) selective() bool {
+	s := f.selector
+	for _, v := range []string{s.Name, s.Glob, s.Regex, s.UUID, s.Category, f.powerState, f.host, f.expr} {
+		if strings.TrimSpace(v) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// selectVMs returns all VMs matching the filter
+func (f bulkFilter) selectVMs(c *client) ([]vm, error) {
+
+	expr, err := parseFilter(f.expr)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := c.listVMsFiltered(expr, sortSpec{}, "v2")
+	if err != nil {
+		return nil, err
+	}
+
+	s := f.selector
+	s.All = true
+	if s.Name != "" || s.Glob != "" || s.Regex != "" || s.UUID != "" || s.Category != "" {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		if vms, err = c.filterVMs(vms, s); err != nil {
+			return nil, err
+		}
+	}
+
+	hostUUID := ""
+	if f.host != "" {
+		hosts, err := c.listHosts()
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			if h.Name == f.host {
+				hostUUID = h.UUID
+			}
+		}
+		if hostUUID == "" {
+			return nil, errors.New("host " + f.host + " not found")
+		}
+	}
+
+	var out []vm
+	for _, v := range vms {
+		if f.powerState != "" && !strings.EqualFold(v.PowerState, f.powerState) {
+			continue
+		}
+		if hostUUID != "" && v.HostUUID != hostUUID {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// runVMBulk is the "vm bulk" command
+func runVMBulk(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm bulk", flag.ExitOnError)
+	var f bulkFilter
+	f.addFlags(fs)
+	var actionName = fs.String("action", "", "action run on every VM: power, resize, snapshot or delete")
+	var po powerOptions
+	fs.StringVar(&po.State, "state", "", "power state of the power action")
+	fs.DurationVar(&po.ForceAfter, "force-after", 0, "power off if a shutdown of the power or resize action did not finish in this time (0 disables)")
+	var ro resizeOptions
+	fs.IntVar(&ro.Vcpus, "vcpus", 0, "vCPUs of the resize action")
+	fs.IntVar(&ro.Cores, "cores", 0, "cores per vCPU of the resize action")
+	fs.IntVar(&ro.MemoryMB, "memory-mb", 0, "memory in MB of the resize action")
+	fs.BoolVar(&ro.PowerCycle, "power-cycle", false, "allow the resize action to power cycle VMs")
+	var snapshotName = fs.String("snapshot-name", "bulk-{{.Name}}", "snapshot name of the snapshot action as Go template with .Name and .UUID of the VM")
+	var deleteSnapshots = fs.Bool("delete-snapshots", false, "delete the snapshots of the VMs with the delete action")
+	var yes = fs.Bool("yes", false, "do not ask for confirmation of the delete action")
+	var parallel = fs.Int("parallel", 4, "number of VMs processed at the same time")
+	var rate = fs.Float64("rate", 0, "maximum number of actions started per second (0 is unlimited)")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for the action on each VM")
+	var dryRun = fs.Bool("dry-run", false, "only print the selected VMs")
+	var jsonOut = fs.Bool("json", false, "print the results as JSON")
+	fs.Parse(args)
+
+	if *parallel < 1 {
+		return errors.New("-parallel has to be at least 1")
+	}
+	if *rate < 0 || *rate > 1000 {
+		return errors.New("-rate has to be between 0 and 1000")
+	}
+
+	po.API, po.Timeout = "v2", *timeout
+	ro.Timeout, ro.ForceAfter = *timeout, po.ForceAfter
+
+	var action bulkAction
+	switch *actionName {
+	case "power":
+		if err := po.validate(); err != nil {
+			return err
+		}
+		action = func(v vm) (string, error) {
+			want := powerTransitions[po.State].State
+			if v.PowerState == want && po.State != "reset" && po.State != "powercycle" && po.State != "reboot" {
+				return "", skipError("already " + want)
+			}
+			return want, c.powerVM(v, po)
+		}
+	case "resize":
+		if err := ro.validate(); err != nil {
+			return err
+		}
+		action = func(v vm) (string, error) {
+			if !ro.changed(v) {
+				return "", skipError("already resized")
+			}
+			return "resized", c.resizeVM(v, ro)
+		}
+	case "snapshot":
+		nameTmpl, err := template.New("snapshot-name").Option("missingkey=error").Parse(*snapshotName)
+		if err != nil {
+			return fmt.Errorf("invalid -snapshot-name: %v", err)
+		}
+		action = func(v vm) (string, error) {
+			var buf bytes.Buffer
+			if err := nameTmpl.Execute(&buf, v); err != nil {
+				return "", err
+			}
+			name := buf.String()
+			return "snapshot " + name, c.snapshotVM(v.UUID, name, *timeout)
+		}
+	case "delete":
+	default:
+		return fmt.Errorf("unknown action %q", *actionName)
+	}
+
+	// actions which stop or remove VMs must not run on the whole cluster by
+	// a forgotten filter
+	destructive := *actionName == "delete" || *actionName == "resize" && ro.PowerCycle ||
+		*actionName == "power" && po.State != "on" && po.State != "resume"
+	if destructive && !f.selective() && !f.all {
+		return fmt.Errorf("the %s action requires a selector, a filter or -all", *actionName)
+	}
+
+	vms, err := f.selectVMs(c)
+	if err != nil {
+		return err
+	}
+
+	// with -json stdout only gets the JSON document, the selection and the
+	// delete plan go to stderr
+	var out io.Writer = os.Stdout
+	if *jsonOut {
+		out = os.Stderr
+	}
+
+	if *dryRun && *actionName != "delete" {
+		for _, v := range vms {
+			fmt.Fprintf(out, "%s (%s) %s\n", v.Name, v.UUID, v.PowerState)
+		}
+		fmt.Fprintf(out, "%d VMs selected\n", len(vms))
+		return nil
+	}
+
+	// the delete action prints the plan of "vm delete" and asks for
+	// confirmation, the snapshots are kept unless -delete-snapshots is set
+	if *actionName == "delete" {
+		keep := !*deleteSnapshots
+		snapshots, vgs, err := c.planDelete(out, vms, keep)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d VMs selected\n", len(vms))
+		if *dryRun || len(vms) == 0 {
+			return nil
+		}
+		if !*yes && !confirm(fmt.Sprintf("Delete %d VMs?", len(vms))) {
+			return errors.New("aborted")
+		}
+		action = func(v vm) (string, error) {
+			return "deleted", c.deleteVMWith(v, snapshots[v.UUID], vgs, keep, false, *timeout)
+		}
+	}
+
+	var progress func(bulkResult)
+	if !*jsonOut {
+		progress = func(r bulkResult) {
+			fmt.Printf("%-8s %s: %s\n", r.Status, r.VM, r.Message)
+		}
+	}
+
+	results := runBulk(vms, *parallel, *rate, action, progress)
+	summary := summarize(results)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Results []bulkResult `json:"results"`
+			Summary bulkSummary  `json:"summary"`
+		}{results, summary})
+	} else {
+		fmt.Printf("%d VMs: %d succeeded, %d failed, %d skipped\n", summary.Total, summary.Succeeded, summary.Failed, summary.Skipped)
+	}
+
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d VMs failed", summary.Failed, summary.Total)
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "vm bulk", usage: "run an action on all VMs matching a filter", run: runVMBulk})
+}
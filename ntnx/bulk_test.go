@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunBulk(t *testing.T) {
+
+	vms := []vm{{Name: "a", UUID: "1"}, {Name: "b", UUID: "2"}, {Name: "c", UUID: "3"}, {Name: "d", UUID: "4"}, {Name: "e", UUID: "5"}}
+	action := func(v vm) (string, error) {
+		time.Sleep(5 * time.Millisecond)
+		switch v.Name {
+		case "b":
+			return "", skipError("already off")
+		case "d":
+			return "", errors.New("boom")
+		}
+		return "done", nil
+	}
+
+	for _, tt := range []struct {
+		name     string
+		parallel int
+		rate     float64
+	}{
+		{"sequential", 1, 0},
+		{"parallel", 3, 0},
+		{"more workers than VMs", 10, 0},
+		{"rate limited", 2, 500},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			running, maxRunning := 0, 0
+			limited := func(v vm) (string, error) {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					running--
+					mu.Unlock()
+				}()
+				return action(v)
+			}
+
+			progressed := 0
+			results := runBulk(vms, tt.parallel, tt.rate, limited, func(bulkResult) { progressed++ })
+
+			var got [][3]string
+			for _, r := range results {
+				got = append(got, [3]string{r.VM, r.Status, r.Message})
+			}
+			want := [][3]string{
+				{"a", "success", "done"},
+				{"b", "skipped", "already off"},
+				{"c", "success", "done"},
+				{"d", "failed", "boom"},
+				{"e", "success", "done"},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if progressed != len(vms) {
+				t.Errorf("progress called %d times, want %d", progressed, len(vms))
+			}
+			if maxRunning > tt.parallel {
+				t.Errorf("%d actions ran at the same time, want at most %d", maxRunning, tt.parallel)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+
+	for _, tt := range []struct {
+		name     string
+		statuses []string
+		want     bulkSummary
+	}{
+		{"empty", nil, bulkSummary{}},
+		{"all succeeded", []string{"success", "success"}, bulkSummary{Total: 2, Succeeded: 2}},
+		{"mixed", []string{"success", "failed", "skipped", "failed"}, bulkSummary{Total: 4, Succeeded: 1, Failed: 2, Skipped: 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []bulkResult
+			for _, s := range tt.statuses {
+				results = append(results, bulkResult{Status: s})
+			}
+			if got := summarize(results); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
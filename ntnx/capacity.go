@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// formatBytes returns b in a human readable form like "1.5 TiB"
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// nonNegative returns v or 0 for the -1 the API sends for unavailable stats
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// tierCapacity is the capacity of a storage tier
+type tierCapacity struct {
+	Name          string `json:"name"`
+	CapacityBytes int64  `json:"capacity_bytes"`
+	UsageBytes    int64  `json:"usage_bytes"`
+	FreeBytes     int64  `json:"free_bytes"`
+}
+
+// capacityReport is the storage capacity of a cluster. The raw values are
+// the physical capacity, the usable values take the replication factor into
+// account.
+type capacityReport struct {
+	Cluster               string         `json:"cluster"`
+	ClusterUUID           string         `json:"cluster_uuid"`
+	ReplicationFactor     int            `json:"replication_factor"`
+	CapacityBytes         int64          `json:"capacity_bytes"`
+	UsageBytes            int64          `json:"usage_bytes"`
+	FreeBytes             int64          `json:"free_bytes"`
+	ReservedCapacityBytes int64          `json:"reserved_capacity_bytes"`
+	ReservedUsageBytes    int64          `json:"reserved_usage_bytes"`
+	ReservedFreeBytes     int64          `json:"reserved_free_bytes"`
+	UsableCapacityBytes   int64          `json:"usable_capacity_bytes"`
+	UsableUsageBytes      int64          `json:"usable_usage_bytes"`
+	UsableFreeBytes       int64          `json:"usable_free_bytes"`
+	UsedPercent           float64        `json:"used_percent"`
+	Tiers                 []tierCapacity `json:"tiers"`
+}
+
+// replicationFactor returns the current replication factor of the cluster.
+// The desired one is used while the cluster is changing it, 2 if both are
+// unknown.
+func (ci clusterInfo) replicationFactor() int {
+	rs := ci.ClusterRedundancyState
+	switch {
+	case rs.CurrentRedundancyFactor > 0:
+		return rs.CurrentRedundancyFactor
+	case rs.DesiredRedundancyFactor > 0:
+		return rs.DesiredRedundancyFactor
+	}
+	return 2
+}
+
+// capacity returns the capacity report of the cluster
+func (ci clusterInfo) capacity() capacityReport {
+
+	u := ci.UsageStats
+	rf := ci.replicationFactor()
+
+	r := capacityReport{
+		Cluster:               ci.Name,
+		ClusterUUID:           ci.UUID,
+		ReplicationFactor:     rf,
+		CapacityBytes:         nonNegative(statValue(u.StorageCapacityBytes)),
+		UsageBytes:            nonNegative(statValue(u.StorageUsageBytes)),
+		FreeBytes:             nonNegative(statValue(u.StorageFreeBytes)),
+		ReservedCapacityBytes: nonNegative(statValue(u.StorageReservedCapacityBytes)),
+		ReservedUsageBytes:    nonNegative(statValue(u.StorageReservedUsageBytes)),
+		ReservedFreeBytes:     nonNegative(statValue(u.StorageReservedFreeBytes)),
+		Tiers: []tierCapacity{
+			{"ssd", nonNegative(statValue(u.StorageTierSsdCapacityBytes)), nonNegative(statValue(u.StorageTierSsdUsageBytes)), nonNegative(statValue(u.StorageTierSsdFreeBytes))},
+			{"das-sata", nonNegative(statValue(u.StorageTierDasSataCapacityBytes)), nonNegative(statValue(u.StorageTierDasSataUsageBytes)), nonNegative(statValue(u.StorageTierDasSataFreeBytes))},
+		},
+	}
+	r.UsableCapacityBytes = r.CapacityBytes / int64(rf)
+	r.UsableUsageBytes = r.UsageBytes / int64(rf)
+	r.UsableFreeBytes = r.FreeBytes / int64(rf)
+	if r.CapacityBytes > 0 {
+		r.UsedPercent = float64(r.UsageBytes) * 100 / float64(r.CapacityBytes)
+	}
+	return r
+}
+
+// capacitySample is a recorded usage of a cluster used by the forecast
+type capacitySample struct {
+	Time          time.Time `json:"time"`
+	ClusterUUID   string    `json:"cluster_uuid"`
+	Cluster       string    `json:"cluster"`
+	CapacityBytes int64     `json:"capacity_bytes"`
+	UsageBytes    int64     `json:"usage_bytes"`
+}
+
+// capacityHistory is the file holding the recorded samples
+type capacityHistory struct {
+	Samples []capacitySample `json:"samples"`
+}
+
+// defaultHistoryFile returns the file name in the home directory of the user
+func defaultHistoryFile(name string) string {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, name)
+}
+
+// loadCapacityHistory reads the samples, a missing file is an empty history
+func loadCapacityHistory(file string) (capacityHistory, error) {
+	var h capacityHistory
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(data, &h)
+	return h, err
+}
+
+// save writes the samples to file
+func (h capacityHistory) save(file string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// capacityForecast is the projected runway of a cluster
+type capacityForecast struct {
+	Cluster        string    `json:"cluster"`
+	ClusterUUID    string    `json:"cluster_uuid"`
+	Samples        int       `json:"samples"`
+	GrowthBytesDay float64   `json:"growth_bytes_per_day"`
+	DaysUntilFull  float64   `json:"days_until_full"`
+	FullAt         time.Time `json:"full_at"`
+	NotEnoughData  bool      `json:"not_enough_data,omitempty"`
+	NotGrowing     bool      `json:"not_growing,omitempty"`
+	CapacityBytes  int64     `json:"capacity_bytes"`
+	LastUsageBytes int64     `json:"last_usage_bytes"`
+	LastSample     time.Time `json:"last_sample"`
+}
+
+// forecast projects the days until the cluster is full with a linear
+// regression of the usage over time
+func (h capacityHistory) forecast(clusterUUID string) capacityForecast {
+
+	var samples []capacitySample
+	for _, s := range h.Samples {
+		if s.ClusterUUID == clusterUUID {
+			samples = append(samples, s)
+		}
+	}
+
+	f := capacityForecast{ClusterUUID: clusterUUID, Samples: len(samples)}
+	if len(samples) == 0 {
+		f.NotEnoughData = true
+		return f
+	}
+	last := samples[len(samples)-1]
+	f.Cluster = last.Cluster
+	f.CapacityBytes = last.CapacityBytes
+	f.LastUsageBytes = last.UsageBytes
+	f.LastSample = last.Time
+
+	// least squares fit of usage = a + b*days since the first sample
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := s.Time.Sub(samples[0].Time).Hours() / 24
+		y := float64(s.UsageBytes)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denom := n*sumXX - sumX*sumX
+	if len(samples) < 2 || denom == 0 {
+		f.NotEnoughData = true
+		return f
+	}
+	b := (n*sumXY - sumX*sumY) / denom
+	a := (sumY - b*sumX) / n
+	f.GrowthBytesDay = b
+	if b <= 0 {
+		f.NotGrowing = true
+		return f
+	}
+
+	// the capacity is reached at x = (capacity - a) / b days after the first
+	// sample, the runway is counted from the last sample
+	full := (float64(last.CapacityBytes) - a) / b
+	lastX := last.Time.Sub(samples[0].Time).Hours() / 24
+	f.DaysUntilFull = full - lastX
+	if f.DaysUntilFull < 0 {
+		f.DaysUntilFull = 0
+	}
+	f.FullAt = last.Time.Add(time.Duration(f.DaysUntilFull * 24 * float64(time.Hour)))
+	return f
+}
+
+// printCapacity prints the capacity reports as table
+func printCapacity(reports []capacityReport) {
+	for _, r := range reports {
+		fmt.Printf("%s (RF%d): %.1f%% used\n", r.Cluster, r.ReplicationFactor, r.UsedPercent)
+		fmt.Printf("  %-10s %12s %12s %12s\n", "", "capacity", "used", "free")
+		fmt.Printf("  %-10s %12s %12s %12s\n", "raw", formatBytes(r.CapacityBytes), formatBytes(r.UsageBytes), formatBytes(r.FreeBytes))
+		fmt.Printf("  %-10s %12s %12s %12s\n", "usable", formatBytes(r.UsableCapacityBytes), formatBytes(r.UsableUsageBytes), formatBytes(r.UsableFreeBytes))
+		if r.ReservedCapacityBytes > 0 {
+			fmt.Printf("  %-10s %12s %12s %12s\n", "reserved", formatBytes(r.ReservedCapacityBytes), formatBytes(r.ReservedUsageBytes), formatBytes(r.ReservedFreeBytes))
+		}
+		for _, t := range r.Tiers {
+			if t.CapacityBytes == 0 {
+				continue
+			}
+			fmt.Printf("  %-10s %12s %12s %12s\n", t.Name, formatBytes(t.CapacityBytes), formatBytes(t.UsageBytes), formatBytes(t.FreeBytes))
+		}
+	}
+}
+
+// printForecast prints the forecasts as table
+func printForecast(forecasts []capacityForecast) {
+	for _, f := range forecasts {
+		switch {
+		case f.NotEnoughData:
+			fmt.Printf("%s: %d samples, at least 2 samples at different times are needed\n", f.Cluster, f.Samples)
+		case f.NotGrowing:
+			fmt.Printf("%s: usage is not growing (%s/day over %d samples)\n", f.Cluster, formatBytes(int64(-f.GrowthBytesDay)), f.Samples)
+		default:
+			fmt.Printf("%s: %.0f days until full (%s), growing %s/day over %d samples\n",
+				f.Cluster, f.DaysUntilFull, f.FullAt.Format("2006-01-02"), formatBytes(int64(f.GrowthBytesDay)), f.Samples)
+		}
+	}
+}
+
+// runClusterCapacity is the "cluster capacity" command
+func runClusterCapacity(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster capacity", flag.ExitOnError)
+	var jsonOut = fs.Bool("json", false, "print the report as JSON")
+	var forecast = fs.Bool("forecast", false, "record a sample and project the days until the clusters are full")
+	var history = fs.String("history", defaultHistoryFile(".ntnx-capacity.json"), "file with the recorded samples of -forecast")
+	var interval = fs.Duration("interval", 0, "with -forecast keep recording samples at this interval until interrupted")
+	fs.Parse(args)
+
+	sample := func() error {
+		clusters, err := c.listAllClusters()
+		if err != nil {
+			return err
+		}
+
+		reports := []capacityReport{}
+		for _, ci := range clusters {
+			reports = append(reports, ci.capacity())
+		}
+		if !*forecast {
+			if *jsonOut {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(reports)
+			}
+			printCapacity(reports)
+			return nil
+		}
+
+		h, err := loadCapacityHistory(*history)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		forecasts := []capacityForecast{}
+		for _, r := range reports {
+			h.Samples = append(h.Samples, capacitySample{Time: now, ClusterUUID: r.ClusterUUID, Cluster: r.Cluster,
+				CapacityBytes: r.CapacityBytes, UsageBytes: r.UsageBytes})
+		}
+		if err := h.save(*history); err != nil {
+			return err
+		}
+		for _, r := range reports {
+			forecasts = append(forecasts, h.forecast(r.ClusterUUID))
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(forecasts)
+		}
+		printForecast(forecasts)
+		return nil
+	}
+
+	if err := sample(); err != nil {
+		return err
+	}
+	if !*forecast || *interval <= 0 {
+		return nil
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := sample(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func init() {
+	register(command{name: "cluster capacity", usage: "report the storage capacity and forecast the days until full", run: runClusterCapacity})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EncodeCredentials this func is encoding the Username and Password with base64 encoding which is
+// required for Nutanix
+func EncodeCredentials(username string, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// v1_0 returns the main entry point for the v1.0 Nutanix API
+func v1_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/PrismGateway/services/rest/v1/"
+
+}
+
+// v2_0 returns the main entry point for the v2.0 Nutanix API
+func v2_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/PrismGateway/services/rest/v2.0/"
+
+}
+
+// v3_0 returns the main entry point for the v3.0 Nutanix API
+func v3_0(NutanixHost string) string {
+
+	return "https://" + NutanixHost + ":9440/api/nutanix/v3/"
+
+}
+
+// apiError is returned if the Nutanix API answers with a status code other than 2xx
+type apiError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	if e.StatusCode == 401 {
+		return "username or password not valid for " + e.URL
+	}
+	return fmt.Sprintf("%s %s returned %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// client holds the connection to a single Nutanix cluster
+type client struct {
+	host       string
+	username   string
+	password   string
+	httpClient *http.Client
+
+	// peers are the clients of the other hosts given with -host, they are
+	// used by the commands reporting on several clusters
+	peers []*client
+
+	// aos caches the AOS version of the cluster for requireAOS
+	aos *aosCache
+}
+
+// newClient returns a client for the Nutanix cluster IP/DNSName. Certificates
+// which can not be validated are ignored because most clusters are running
+// with the self signed certificate.
+func newClient(host string, username string, password string) *client {
+
+	// Ignores certificates which can not be validated
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	return &client{
+		host:       host,
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{Transport: tr, Timeout: 120 * time.Second},
+		aos:        &aosCache{},
+	}
+}
+
+// all returns the client and its peers
+func (c *client) all() []*client {
+	return append([]*client{c}, c.peers...)
+}
+
+// v1 returns the url of path for the v1 API
+func (c *client) v1(path string) string { return v1_0(c.host) + strings.TrimPrefix(path, "/") }
+
+// v2 returns the url of path for the v2 API
+func (c *client) v2(path string) string { return v2_0(c.host) + strings.TrimPrefix(path, "/") }
+
+// v3 returns the url of path for the v3 API
+func (c *client) v3(path string) string { return v3_0(c.host) + strings.TrimPrefix(path, "/") }
+
+// do sends the request to url. in is marshalled as JSON body if not nil and
+// the JSON response is unmarshalled into out if not nil.
+func (c *client) do(method string, url string, in interface{}, out interface{}) error {
+
+	// fail fast with a clear error instead of a 404 of an older cluster
+	if err := c.requireAOSForURL(url); err != nil {
+		return err
+	}
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// before the request is send set the HTTP Header key "Authorization" with
+	// the value of base64 encoded Username and Password
+	req.Header.Set("Authorization", "Basic "+EncodeCredentials(c.username, c.password))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// read the data from the resp.body into bodyText
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{Method: method, URL: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(bodyText)}
+	}
+
+	if out == nil || len(bodyText) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(bodyText, out)
+}
+
+// get sends a GET to url and unmarshals the response into out
+func (c *client) get(url string, out interface{}) error {
+	return c.do("GET", url, nil, out)
+}
+
+// post sends in as POST to url and unmarshals the response into out
+func (c *client) post(url string, in interface{}, out interface{}) error {
+	return c.do("POST", url, in, out)
+}
+
+// put sends in as PUT to url and unmarshals the response into out
+func (c *client) put(url string, in interface{}, out interface{}) error {
+	return c.do("PUT", url, in, out)
+}
+
+// delete sends a DELETE to url and unmarshals the response into out
+func (c *client) delete(url string, out interface{}) error {
+	return c.do("DELETE", url, nil, out)
+}
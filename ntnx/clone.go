@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// cloneData is passed to the name pattern and the cloud-init template of
+// every clone
+type cloneData struct {
+	Index  int
+	Name   string
+	IP     string
+	Source string
+}
+
+// cloneSpec is a single clone of the v2 /vms/{uuid}/clone request
+type cloneSpec struct {
+	Name                  string         `json:"name"`
+	MemoryMB              int            `json:"memory_mb,omitempty"`
+	NumVcpus              int            `json:"num_vcpus,omitempty"`
+	NumCoresPerVcpu       int            `json:"num_cores_per_vcpu,omitempty"`
+	OverrideNetworkConfig bool           `json:"override_network_config,omitempty"`
+	VMNics                []vmNicRequest `json:"vm_nics,omitempty"`
+}
+
+// cloneRequest is the body of a v2 POST /vms/{uuid}/clone
+type cloneRequest struct {
+	SpecList              []cloneSpec      `json:"spec_list"`
+	VMCustomizationConfig *vmCustomization `json:"vm_customization_config,omitempty"`
+}
+
+// cloneResult is the result of a single clone
+type cloneResult struct {
+	Name     string
+	UUID     string
+	TaskUUID string
+	Err      error
+}
+
+// nextIP returns the IPv4 address n addresses after ip
+func nextIP(ip net.IP, n int) net.IP {
+	ip4 := ip.To4()
+	v := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+	v += uint32(n)
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// render executes the template t with data
+func render(t *template.Template, data cloneData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// cloneVM sends the clone request and waits for the task
+func (c *client) cloneVM(source string, req *cloneRequest, timeout time.Duration) (cloneResult, error) {
+
+	res := cloneResult{Name: req.SpecList[0].Name}
+
+	var resp taskResponse
+	if err := c.post(c.v2("/vms/"+source+"/clone"), req, &resp); err != nil {
+		return res, err
+	}
+	res.TaskUUID = resp.TaskUUID
+
+	t, err := c.waitTask(resp.TaskUUID, timeout)
+	if err != nil {
+		return res, err
+	}
+
+	for _, e := range t.EntityList {
+		if strings.EqualFold(e.EntityType, "VM") && e.EntityID != source {
+			res.UUID = e.EntityID
+		}
+	}
+	if res.UUID == "" {
+		return res, fmt.Errorf("task %s returned no VM uuid for the clone", resp.TaskUUID)
+	}
+
+	return res, nil
+}
+
+// runVMClone is the "vm clone" command
+func runVMClone(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm clone", flag.ExitOnError)
+	var s vmSelector
+	s.addFlags(fs)
+	var count = fs.Int("count", 1, "number of clones")
+	var start = fs.Int("start", 1, "index of the first clone")
+	var pattern = fs.String("pattern", "{{.Source}}-{{.Index}}", "name of the clones as Go template with .Index and .Source")
+	var memoryMB = fs.Int("memory-mb", 0, "memory of the clones in MB (default of the source VM)")
+	var vcpus = fs.Int("vcpus", 0, "vCPUs of the clones (default of the source VM)")
+	var cores = fs.Int("cores", 0, "cores per vCPU of the clones (default of the source VM)")
+	var networkName = fs.String("network", "", "network of the NIC of the clones (default are the NICs of the source VM)")
+	var ipStart = fs.String("ip-start", "", "static IP of the first clone, every clone receives the next IP")
+	var cloudInit = fs.String("cloud-init", "", "cloud-init user data file as Go template with .Index, .Name, .IP and .Source")
+	var parallel = fs.Int("parallel", 4, "number of clones running at the same time")
+	var timeout = fs.Duration("timeout", 15*time.Minute, "time to wait for each clone")
+	var powerOn = fs.Bool("power-on", false, "power on the clones")
+	fs.Parse(args)
+
+	if *count < 1 || *parallel < 1 {
+		return errors.New("-count and -parallel have to be at least 1")
+	}
+	if *ipStart != "" && *networkName == "" {
+		return errors.New("-ip-start requires -network")
+	}
+
+	// the source has to be a single VM
+	s.All = false
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+	source := vms[0]
+
+	nameTmpl, err := template.New("pattern").Option("missingkey=error").Parse(*pattern)
+	if err != nil {
+		return err
+	}
+
+	var userdataTmpl *template.Template
+	if *cloudInit != "" {
+		data, err := ioutil.ReadFile(*cloudInit)
+		if err != nil {
+			return err
+		}
+		if userdataTmpl, err = template.New("cloud-init").Option("missingkey=error").Parse(string(data)); err != nil {
+			return err
+		}
+	}
+
+	var firstIP net.IP
+	if *ipStart != "" {
+		if firstIP = net.ParseIP(*ipStart); firstIP == nil || firstIP.To4() == nil {
+			return fmt.Errorf("%q is not a valid IPv4 address", *ipStart)
+		}
+	}
+
+	var r *resources
+	if *networkName != "" {
+		if r, err = c.loadResources(); err != nil {
+			return err
+		}
+	}
+
+	// all clone requests are build and validated before the first clone starts
+	existing, err := c.listVMs()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, v := range existing {
+		names[v.Name] = true
+	}
+
+	var reqs []*cloneRequest
+	var errs []error
+
+	for i := 0; i < *count; i++ {
+
+		data := cloneData{Index: *start + i, Source: source.Name}
+		if firstIP != nil {
+			data.IP = nextIP(firstIP, i).String()
+		}
+
+		if data.Name, err = render(nameTmpl, data); err != nil {
+			return err
+		}
+		if names[data.Name] {
+			errs = append(errs, fmt.Errorf("a VM named %q already exists", data.Name))
+		}
+		names[data.Name] = true
+
+		spec := cloneSpec{Name: data.Name, MemoryMB: *memoryMB, NumVcpus: *vcpus, NumCoresPerVcpu: *cores}
+
+		if *networkName != "" {
+			nic := nicSpec{Network: *networkName, IP: data.IP}
+			if nicErrs := nic.validate(0, r); len(nicErrs) > 0 {
+				for _, e := range nicErrs {
+					errs = append(errs, fmt.Errorf("%s: %v", data.Name, e))
+				}
+				continue
+			}
+			spec.OverrideNetworkConfig = true
+			spec.VMNics = nicRequests([]nicSpec{nic}, r)
+		}
+
+		req := &cloneRequest{SpecList: []cloneSpec{spec}}
+
+		// the customization is part of the request and not of the spec, so
+		// every clone is send as its own request
+		if userdataTmpl != nil {
+			userdata, err := render(userdataTmpl, data)
+			if err != nil {
+				return err
+			}
+			req.VMCustomizationConfig = customization(userdata, "")
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	if err := joinErrors(errs); err != nil {
+		return err
+	}
+
+	// the clones are running in a bounded pool of workers
+	results := make([]cloneResult, len(reqs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < *parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res, err := c.cloneVM(source.UUID, reqs[i], *timeout)
+				if err == nil && *powerOn {
+					o := powerOptions{State: "on", API: "v2", Timeout: *timeout}
+					err = c.powerVM(vm{UUID: res.UUID, Name: res.Name}, o)
+				}
+				res.Err = err
+				results[i] = res
+
+				if err != nil {
+					fmt.Printf("%s: failed: %v\n", res.Name, err)
+				} else {
+					fmt.Printf("%s: cloned (%s)\n", res.Name, res.UUID)
+				}
+			}
+		}()
+	}
+
+	for i := range reqs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	fmt.Printf("\n%-30s %-38s %-34s %s\n", "NAME", "UUID", "TASK", "RESULT")
+	for _, res := range results {
+		result := "ok"
+		if res.Err != nil {
+			result = res.Err.Error()
+			failed++
+		}
+		fmt.Printf("%-30s %-38s %-34s %s\n", res.Name, res.UUID, res.TaskUUID, result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clones failed", failed, len(results))
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "vm clone", usage: "clone a VM into N customized copies", run: runVMClone})
+}
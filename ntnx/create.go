@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// diskSpec is a disk in a VM spec file. A disk is either cloned from Image or
+// created empty with SizeGB on Container. A CD-ROM is empty or cloned from an
+// ISO image.
+type diskSpec struct {
+	Image     string `json:"image"`
+	Container string `json:"container"`
+	SizeGB    int64  `json:"size_gb"`
+	Cdrom     bool   `json:"cdrom"`
+	Bus       string `json:"bus"`
+}
+
+// nicSpec is a NIC in a VM spec file. IP requests a static IP from the AHV
+// IP address management of the network.
+type nicSpec struct {
+	Network string `json:"network"`
+	IP      string `json:"ip"`
+}
+
+// vmSpec is the spec file of "vm create"
+//
+//	name: web-01
+//	vcpus: 2
+//	cores_per_vcpu: 1
+//	memory_mb: 4096
+//	disks:
+//	  - image: centos7
+//	    size_gb: 40
+//	  - container: default-container
+//	    size_gb: 100
+//	  - cdrom: true
+//	nics:
+//	  - network: vlan10
+//	    ip: 10.10.0.21
+//	boot_order: [disk, cdrom, network]
+//	cloud_init: |
+//	  #cloud-config
+//	power_on: true
+type vmSpec struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Vcpus         int        `json:"vcpus"`
+	CoresPerVcpu  int        `json:"cores_per_vcpu"`
+	MemoryMB      int        `json:"memory_mb"`
+	Disks         []diskSpec `json:"disks"`
+	Nics          []nicSpec  `json:"nics"`
+	BootOrder     []string   `json:"boot_order"`
+	CloudInit     string     `json:"cloud_init"`
+	CloudInitFile string     `json:"cloud_init_file"`
+	Sysprep       string     `json:"sysprep"`
+	SysprepFile   string     `json:"sysprep_file"`
+	PowerOn       bool       `json:"power_on"`
+}
+
+// diskAddress addresses a disk of a VM or the disk of an image
+type diskAddress struct {
+	DeviceBus   string `json:"device_bus,omitempty"`
+	DeviceIndex int    `json:"device_index"`
+	VMDiskUUID  string `json:"vmdisk_uuid,omitempty"`
+}
+
+// vmDiskClone clones a disk from an image or another VM disk
+type vmDiskClone struct {
+	DiskAddress          diskAddress `json:"disk_address"`
+	MinimumSize          int64       `json:"minimum_size,omitempty"`
+	StorageContainerUUID string      `json:"storage_container_uuid,omitempty"`
+}
+
+// vmDiskCreate creates an empty disk on a container
+type vmDiskCreate struct {
+	StorageContainerUUID string `json:"storage_container_uuid"`
+	Size                 int64  `json:"size"`
+}
+
+// vmDiskRequest is a disk of the v2 VM create and update requests
+type vmDiskRequest struct {
+	IsCdrom      bool          `json:"is_cdrom"`
+	IsEmpty      bool          `json:"is_empty,omitempty"`
+	DiskAddress  *diskAddress  `json:"disk_address,omitempty"`
+	VMDiskClone  *vmDiskClone  `json:"vm_disk_clone,omitempty"`
+	VMDiskCreate *vmDiskCreate `json:"vm_disk_create,omitempty"`
+}
+
+// vmNicRequest is a NIC of the v2 VM create and update requests
+type vmNicRequest struct {
+	NetworkUUID        string `json:"network_uuid"`
+	RequestedIPAddress string `json:"requested_ip_address,omitempty"`
+	RequestIP          bool   `json:"request_ip,omitempty"`
+}
+
+// vmCustomization is the cloud-init or sysprep configuration of a new VM
+type vmCustomization struct {
+	Userdata       string `json:"userdata"`
+	DatasourceType string `json:"datasource_type,omitempty"`
+	FreshInstall   bool   `json:"fresh_install,omitempty"`
+}
+
+// vmCreateRequest is the body of a v2 POST /vms
+type vmCreateRequest struct {
+	Name                  string           `json:"name"`
+	Description           string           `json:"description,omitempty"`
+	MemoryMB              int              `json:"memory_mb"`
+	NumVcpus              int              `json:"num_vcpus"`
+	NumCoresPerVcpu       int              `json:"num_cores_per_vcpu"`
+	VMDisks               []vmDiskRequest  `json:"vm_disks,omitempty"`
+	VMNics                []vmNicRequest   `json:"vm_nics,omitempty"`
+	Boot                  *vmBoot          `json:"boot,omitempty"`
+	VMCustomizationConfig *vmCustomization `json:"vm_customization_config,omitempty"`
+}
+
+// vmBoot is the boot configuration of a VM
+type vmBoot struct {
+	BootDeviceOrder []string `json:"boot_device_order"`
+}
+
+// bootDevices maps the boot_order names of a spec file to the v2 boot devices
+var bootDevices = map[string]string{
+	"disk":    "DISK",
+	"cdrom":   "CDROM",
+	"network": "NIC",
+}
+
+// readSpecFile reads the VM spec file. cloud_init_file and sysprep_file are
+// read relative to the directory of the spec file.
+func readSpecFile(name string) (*vmSpec, error) {
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var s vmSpec
+	if err := decodeSpec(name, data, &s); err != nil {
+		return nil, err
+	}
+
+	if err := s.readUserdata(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// readUserdata reads cloud_init_file and sysprep_file relative to dir
+func (s *vmSpec) readUserdata(dir string) error {
+
+	for _, f := range []struct {
+		file string
+		data *string
+	}{{s.CloudInitFile, &s.CloudInit}, {s.SysprepFile, &s.Sysprep}} {
+
+		if f.file == "" {
+			continue
+		}
+		if *f.data != "" {
+			return fmt.Errorf("%s is given inline and as file", f.file)
+		}
+		if !filepath.IsAbs(f.file) {
+			f.file = filepath.Join(dir, f.file)
+		}
+		data, err := ioutil.ReadFile(f.file)
+		if err != nil {
+			return err
+		}
+		*f.data = string(data)
+	}
+
+	return nil
+}
+
+// validate checks the spec against the images, containers, networks and VMs
+// of the cluster and returns all errors found
+func (s *vmSpec) validate(r *resources, vms []vm) []error {
+
+	var errs []error
+
+	if s.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	for _, v := range vms {
+		if v.Name == s.Name {
+			errs = append(errs, fmt.Errorf("a VM named %q already exists (%s)", s.Name, v.UUID))
+			break
+		}
+	}
+	if s.Vcpus < 1 {
+		errs = append(errs, errors.New("vcpus has to be at least 1"))
+	}
+	if s.MemoryMB < 1 {
+		errs = append(errs, errors.New("memory_mb has to be at least 1"))
+	}
+	if s.CloudInit != "" && s.Sysprep != "" {
+		errs = append(errs, errors.New("cloud_init and sysprep can not be used together"))
+	}
+
+	for i, d := range s.Disks {
+		errs = append(errs, d.validate(i, r)...)
+	}
+
+	for i, n := range s.Nics {
+		errs = append(errs, n.validate(i, r)...)
+	}
+
+	for _, b := range s.BootOrder {
+		if _, ok := bootDevices[b]; !ok {
+			errs = append(errs, fmt.Errorf("unknown boot device %q, use disk, cdrom or network", b))
+		}
+	}
+
+	return errs
+}
+
+// validate checks the disk i against the images and containers
+func (d diskSpec) validate(i int, r *resources) []error {
+
+	var errs []error
+	prefix := fmt.Sprintf("disk %d: ", i)
+
+	if d.Image != "" {
+		img, err := r.image(d.Image)
+		if err != nil {
+			errs = append(errs, errors.New(prefix+err.Error()))
+		} else if d.Cdrom && img.ImageType != "ISO_IMAGE" {
+			errs = append(errs, fmt.Errorf("%simage %q is not an ISO image", prefix, d.Image))
+		} else if !d.Cdrom && img.ImageType == "ISO_IMAGE" {
+			errs = append(errs, fmt.Errorf("%simage %q is an ISO image, use cdrom: true", prefix, d.Image))
+		} else if img.VMDiskID == "" {
+			errs = append(errs, fmt.Errorf("%simage %q has no disk, is it still uploading?", prefix, d.Image))
+		}
+	} else if !d.Cdrom && (d.Container == "" || d.SizeGB < 1) {
+		errs = append(errs, errors.New(prefix+"an empty disk requires container and size_gb"))
+	}
+
+	if d.Container != "" {
+		if _, err := r.container(d.Container); err != nil {
+			errs = append(errs, errors.New(prefix+err.Error()))
+		}
+	}
+
+	switch d.Bus {
+	case "", "scsi", "ide", "sata", "pci":
+	default:
+		errs = append(errs, fmt.Errorf("%sunknown bus %q", prefix, d.Bus))
+	}
+
+	return errs
+}
+
+// validate checks the NIC i against the networks
+func (n nicSpec) validate(i int, r *resources) []error {
+
+	prefix := fmt.Sprintf("nic %d: ", i)
+
+	nw, err := r.network(n.Network)
+	if err != nil {
+		return []error{errors.New(prefix + err.Error())}
+	}
+
+	if n.IP == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(n.IP)
+	if ip == nil || ip.To4() == nil {
+		return []error{fmt.Errorf("%s%q is not a valid IPv4 address", prefix, n.IP)}
+	}
+
+	// a static IP can only be requested from a network managed by AHV
+	if nw.IPConfig.NetworkAddress == "" {
+		return []error{fmt.Errorf("%snetwork %q has no IP address management, %s can not be requested", prefix, n.Network, n.IP)}
+	}
+
+	subnet := &net.IPNet{
+		IP:   net.ParseIP(nw.IPConfig.NetworkAddress),
+		Mask: net.CIDRMask(nw.IPConfig.PrefixLength, 32),
+	}
+	if !subnet.Contains(ip) {
+		return []error{fmt.Errorf("%s%s is not in network %q (%s)", prefix, n.IP, n.Network, subnet)}
+	}
+
+	return nil
+}
+
+// diskRequests converts the disks of the spec into v2 disk requests. The
+// spec has to be validated.
+func diskRequests(disks []diskSpec, r *resources) []vmDiskRequest {
+
+	var out []vmDiskRequest
+	index := make(map[string]int)
+
+	for _, d := range disks {
+
+		bus := d.Bus
+		if bus == "" {
+			bus = "scsi"
+			if d.Cdrom {
+				bus = "ide"
+			}
+		}
+		addr := diskAddress{DeviceBus: bus, DeviceIndex: index[bus]}
+		index[bus]++
+
+		req := vmDiskRequest{IsCdrom: d.Cdrom, DiskAddress: &addr}
+
+		switch {
+		case d.Image != "":
+			img, _ := r.image(d.Image)
+			req.VMDiskClone = &vmDiskClone{
+				DiskAddress: diskAddress{VMDiskUUID: img.VMDiskID},
+				MinimumSize: d.SizeGB << 30,
+			}
+			if d.Container != "" {
+				sc, _ := r.container(d.Container)
+				req.VMDiskClone.StorageContainerUUID = sc.UUID
+			}
+		case d.Cdrom:
+			req.IsEmpty = true
+		default:
+			sc, _ := r.container(d.Container)
+			req.VMDiskCreate = &vmDiskCreate{StorageContainerUUID: sc.UUID, Size: d.SizeGB << 30}
+		}
+
+		out = append(out, req)
+	}
+
+	return out
+}
+
+// nicRequests converts the NICs of the spec into v2 NIC requests. The spec
+// has to be validated.
+func nicRequests(nics []nicSpec, r *resources) []vmNicRequest {
+	var out []vmNicRequest
+	for _, n := range nics {
+		nw, _ := r.network(n.Network)
+		out = append(out, vmNicRequest{
+			NetworkUUID:        nw.UUID,
+			RequestedIPAddress: n.IP,
+			RequestIP:          n.IP != "",
+		})
+	}
+	return out
+}
+
+// customization returns the cloud-init or sysprep configuration or nil
+func customization(cloudInit string, sysprep string) *vmCustomization {
+	switch {
+	case cloudInit != "":
+		return &vmCustomization{Userdata: cloudInit, DatasourceType: "CONFIG_DRIVE_V2"}
+	case sysprep != "":
+		return &vmCustomization{Userdata: sysprep}
+	}
+	return nil
+}
+
+// request converts the validated spec into the v2 create request
+func (s *vmSpec) request(r *resources) *vmCreateRequest {
+
+	req := &vmCreateRequest{
+		Name:                  s.Name,
+		Description:           s.Description,
+		MemoryMB:              s.MemoryMB,
+		NumVcpus:              s.Vcpus,
+		NumCoresPerVcpu:       s.CoresPerVcpu,
+		VMDisks:               diskRequests(s.Disks, r),
+		VMNics:                nicRequests(s.Nics, r),
+		VMCustomizationConfig: customization(s.CloudInit, s.Sysprep),
+	}
+
+	if req.NumCoresPerVcpu == 0 {
+		req.NumCoresPerVcpu = 1
+	}
+
+	if len(s.BootOrder) > 0 {
+		req.Boot = &vmBoot{}
+		for _, b := range s.BootOrder {
+			req.Boot.BootDeviceOrder = append(req.Boot.BootDeviceOrder, bootDevices[b])
+		}
+	}
+
+	return req
+}
+
+// createVM sends the create request, waits for the task and returns the UUID
+// of the new VM
+func (c *client) createVM(req *vmCreateRequest, timeout time.Duration) (string, error) {
+
+	var resp taskResponse
+	if err := c.post(c.v2("/vms/"), req, &resp); err != nil {
+		return "", err
+	}
+
+	t, err := c.waitTask(resp.TaskUUID, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range t.EntityList {
+		if strings.EqualFold(e.EntityType, "VM") {
+			return e.EntityID, nil
+		}
+	}
+	return "", errors.New("task " + t.UUID + " did not return the new VM")
+}
+
+// joinErrors joins all errors into a single error with one line each
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, "  "+err.Error())
+	}
+	return fmt.Errorf("%d errors:\n%s", len(errs), strings.Join(lines, "\n"))
+}
+
+// runVMCreate is the "vm create" command
+func runVMCreate(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm create", flag.ExitOnError)
+	var file = fs.String("f", "", "VM spec file (YAML or JSON)")
+	var dryRun = fs.Bool("dry-run", false, "validate the spec and print the request without creating the VM")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for the VM to be created")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-f is required")
+	}
+
+	s, err := readSpecFile(*file)
+	if err != nil {
+		return err
+	}
+
+	// all names of the spec are validated against the cluster before
+	// anything is submitted
+	r, err := c.loadResources()
+	if err != nil {
+		return err
+	}
+	vms, err := c.listVMs()
+	if err != nil {
+		return err
+	}
+	if err := joinErrors(s.validate(r, vms)); err != nil {
+		return fmt.Errorf("%s: %v", *file, err)
+	}
+
+	req := s.request(r)
+
+	if *dryRun {
+		data, _ := json.MarshalIndent(req, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+
+	uuid, err := c.createVM(req, *timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: created (%s)\n", s.Name, uuid)
+
+	if s.PowerOn {
+		o := powerOptions{State: "on", API: "v2", Timeout: *timeout}
+		if err := c.powerVM(vm{UUID: uuid, Name: s.Name}, o); err != nil {
+			return err
+		}
+		fmt.Printf("%s: on\n", s.Name)
+	}
+
+	return nil
+}
+
+func init() {
+	register(command{name: "vm create", usage: "create a VM from a YAML or JSON spec file", run: runVMCreate})
+}
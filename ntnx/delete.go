@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// snapshot is a VM snapshot as returned by the v2 /snapshots API
+type snapshot struct {
+	UUID         string `json:"uuid"`
+	SnapshotName string `json:"snapshot_name"`
+	VMUUID       string `json:"vm_uuid"`
+	CreatedTime  int64  `json:"created_time"`
+	Deleted      bool   `json:"deleted"`
+}
+
+// volumeGroup is a volume group as returned by the v2 /volume_groups API
+type volumeGroup struct {
+	UUID           string `json:"uuid"`
+	Name           string `json:"name"`
+	AttachmentList []struct {
+		VMUUID string `json:"vm_uuid"`
+	} `json:"attachment_list"`
+}
+
+// preDeleteSnapshotLayout is the time layout of the expiry in the names of
+// the snapshots taken by "vm delete -snapshot"
+const preDeleteSnapshotLayout = "20060102T150405Z"
+
+// preDeleteSnapshotRe matches the snapshot names and captures the expiry
+var preDeleteSnapshotRe = regexp.MustCompile(`^predelete-.*-until-(\d{8}T\d{6}Z)$`)
+
+// preDeleteSnapshotName returns the name of the snapshot of the VM kept until
+// expiry. The expiry is part of the name, so "vm purge-snapshots" needs no
+// local state.
+func preDeleteSnapshotName(name string, expiry time.Time) string {
+	return "predelete-" + name + "-until-" + expiry.UTC().Format(preDeleteSnapshotLayout)
+}
+
+// listSnapshots returns the snapshots of the VM or all snapshots if uuid is empty
+func (c *client) listSnapshots(uuid string) ([]snapshot, error) {
+	path := "/snapshots/"
+	if uuid != "" {
+		path += "?vm_uuid=" + url.QueryEscape(uuid)
+	}
+	var resp struct {
+		Entities []snapshot `json:"entities"`
+	}
+	if err := c.get(c.v2(path), &resp); err != nil {
+		return nil, err
+	}
+
+	// older versions ignore the vm_uuid filter
+	var out []snapshot
+	for _, s := range resp.Entities {
+		if !s.Deleted && (uuid == "" || s.VMUUID == uuid) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// listVolumeGroups returns all volume groups
+func (c *client) listVolumeGroups() ([]volumeGroup, error) {
+	var resp struct {
+		Entities []volumeGroup `json:"entities"`
+	}
+	err := c.get(c.v2("/volume_groups/"), &resp)
+	return resp.Entities, err
+}
+
+// snapshotVM takes a snapshot of the VM and waits for the task
+func (c *client) snapshotVM(uuid string, name string, timeout time.Duration) error {
+	body := map[string]interface{}{
+		"snapshot_specs": []map[string]string{{"vm_uuid": uuid, "snapshot_name": name}},
+	}
+	var resp taskResponse
+	if err := c.post(c.v2("/snapshots/"), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// deleteSnapshot deletes the snapshot and waits for the task
+func (c *client) deleteSnapshot(uuid string, timeout time.Duration) error {
+	var resp taskResponse
+	if err := c.delete(c.v2("/snapshots/"+uuid), &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// detachVolumeGroup detaches the volume group from the VM and waits for the task
+func (c *client) detachVolumeGroup(vgUUID string, vmUUID string, timeout time.Duration) error {
+	body := map[string]string{"operation": "DETACH", "vm_uuid": vmUUID}
+	var resp taskResponse
+	if err := c.post(c.v2("/volume_groups/"+vgUUID+"/detach"), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// attachedVolumeGroups returns the volume groups of vgs attached to the VM
+func attachedVolumeGroups(vgs []volumeGroup, uuid string) []volumeGroup {
+	var out []volumeGroup
+	for _, vg := range vgs {
+		for _, a := range vg.AttachmentList {
+			if a.VMUUID == uuid {
+				out = append(out, vg)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// deleteVM deletes the VM and waits for the task
+func (c *client) deleteVM(uuid string, deleteSnapshots bool, timeout time.Duration) error {
+	var resp taskResponse
+	if err := c.delete(c.v2(fmt.Sprintf("/vms/%s?delete_snapshots=%t", uuid, deleteSnapshots)), &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// printDeletePlan prints everything which is removed with the VMs to w
+func printDeletePlan(w io.Writer, vms []vm, snapshots map[string][]snapshot, vgs []volumeGroup, r *resources, keepSnapshots bool) {
+
+	containerNames := make(map[string]string)
+	for _, sc := range r.containers {
+		containerNames[sc.UUID] = sc.Name
+	}
+
+	for _, v := range vms {
+		fmt.Fprintf(w, "VM %s (%s) power state %s\n", v.Name, v.UUID, v.PowerState)
+
+		for _, d := range v.VMDiskInfo {
+			kind := "disk"
+			if d.IsCdrom {
+				kind = "cdrom"
+			}
+			fmt.Fprintf(w, "  delete %s %s.%d %d GiB on %s\n", kind, d.DiskAddress.DeviceBus, d.DiskAddress.DeviceIndex,
+				d.Size>>30, containerNames[d.StorageContainerUUID])
+		}
+
+		for _, s := range snapshots[v.UUID] {
+			action := "delete"
+			if keepSnapshots {
+				action = "keep"
+			}
+			created := time.Unix(0, s.CreatedTime*int64(time.Microsecond)).UTC().Format(time.RFC3339)
+			fmt.Fprintf(w, "  %s snapshot %s created %s\n", action, s.SnapshotName, created)
+		}
+
+		for _, vg := range attachedVolumeGroups(vgs, v.UUID) {
+			fmt.Fprintf(w, "  detach volume group %s (%s)\n", vg.Name, vg.UUID)
+		}
+	}
+}
+
+// planDelete lists the snapshots and volume groups of the VMs and prints the
+// delete plan to w
+func (c *client) planDelete(w io.Writer, vms []vm, keepSnapshots bool) (map[string][]snapshot, []volumeGroup, error) {
+
+	r, err := c.loadResources()
+	if err != nil {
+		return nil, nil, err
+	}
+	vgs, err := c.listVolumeGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots := make(map[string][]snapshot)
+	for _, v := range vms {
+		if snapshots[v.UUID], err = c.listSnapshots(v.UUID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	printDeletePlan(w, vms, snapshots, vgs, r, keepSnapshots)
+	return snapshots, vgs, nil
+}
+
+// deleteVMWith detaches the volume groups of the VM and deletes it. The
+// snapshots listed in snapshots are deleted unless keepSnapshots is set. A
+// snapshot taken before the delete has to survive it, the listed snapshots
+// are deleted one by one then instead of with the VM.
+func (c *client) deleteVMWith(v vm, snapshots []snapshot, vgs []volumeGroup, keepSnapshots bool, tookSnapshot bool, timeout time.Duration) error {
+
+	for _, vg := range attachedVolumeGroups(vgs, v.UUID) {
+		if err := c.detachVolumeGroup(vg.UUID, v.UUID, timeout); err != nil {
+			return fmt.Errorf("detach volume group %s: %v", vg.Name, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: detached volume group %s\n", v.Name, vg.Name)
+	}
+
+	if !keepSnapshots && tookSnapshot {
+		for _, s := range snapshots {
+			if err := c.deleteSnapshot(s.UUID, timeout); err != nil {
+				return fmt.Errorf("delete snapshot %s: %v", s.SnapshotName, err)
+			}
+		}
+	}
+
+	return c.deleteVM(v.UUID, !keepSnapshots && !tookSnapshot, timeout)
+}
+
+// confirm asks the user on stderr to type yes
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question+" Type yes to continue: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// runVMDelete is the "vm delete" command
+func runVMDelete(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm delete", flag.ExitOnError)
+	var s vmSelector
+	s.addFlags(fs)
+	var yes = fs.Bool("yes", false, "do not ask for confirmation")
+	var dryRun = fs.Bool("dry-run", false, "only print what would be deleted")
+	var takeSnapshot = fs.Bool("snapshot", false, "take a snapshot of each VM before it is deleted and keep it for -retention")
+	var retention = fs.Duration("retention", 7*24*time.Hour, "time the snapshot taken with -snapshot is kept")
+	var keepSnapshots = fs.Bool("keep-snapshots", false, "keep the existing snapshots of the VMs")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for each snapshot and delete")
+	fs.Parse(args)
+
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+
+	snapshots, vgs, err := c.planDelete(os.Stdout, vms, *keepSnapshots)
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().Add(*retention)
+	if *takeSnapshot {
+		fmt.Printf("a snapshot of each VM is kept until %s\n", expiry.UTC().Format(time.RFC3339))
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Delete %d VMs?", len(vms))) {
+		return errors.New("aborted")
+	}
+
+	failed := 0
+	for _, v := range vms {
+		if *takeSnapshot {
+			name := preDeleteSnapshotName(v.Name, expiry)
+			if err := c.snapshotVM(v.UUID, name, *timeout); err != nil {
+				fmt.Printf("%s: snapshot failed, not deleted: %v\n", v.Name, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s: snapshot %s\n", v.Name, name)
+		}
+
+		if err := c.deleteVMWith(v, snapshots[v.UUID], vgs, *keepSnapshots, *takeSnapshot, *timeout); err != nil {
+			fmt.Printf("%s: %v\n", v.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: deleted\n", v.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d VMs failed", failed, len(vms))
+	}
+	return nil
+}
+
+// runVMPurgeSnapshots is the "vm purge-snapshots" command which deletes the
+// snapshots of "vm delete -snapshot" after their retention
+func runVMPurgeSnapshots(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm purge-snapshots", flag.ExitOnError)
+	var dryRun = fs.Bool("dry-run", false, "only print the expired snapshots")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for each delete")
+	fs.Parse(args)
+
+	snapshots, err := c.listSnapshots("")
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, s := range snapshots {
+		m := preDeleteSnapshotRe.FindStringSubmatch(s.SnapshotName)
+		if m == nil {
+			continue
+		}
+		expiry, err := time.Parse(preDeleteSnapshotLayout, m[1])
+		if err != nil || time.Now().Before(expiry) {
+			continue
+		}
+
+		if *dryRun {
+			fmt.Printf("%s: expired\n", s.SnapshotName)
+			continue
+		}
+
+		if err := c.deleteSnapshot(s.UUID, *timeout); err != nil {
+			fmt.Printf("%s: %v\n", s.SnapshotName, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: deleted\n", s.SnapshotName)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d snapshots failed", failed)
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "vm delete", usage: "delete VMs after confirmation, optionally keeping a snapshot", run: runVMDelete})
+	register(command{name: "vm purge-snapshots", usage: "delete the snapshots of vm delete after their retention", run: runVMPurgeSnapshots})
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A filter expression selects resources by their v2 field names. Clauses are
+// joined with ; (and) and , (or), and binds stronger than or like in FIQL:
+//
+//	power_state==on;name=~^db-
+//	num_vcpus>=4,memory_mb>8192
+//
+// The operators are == != =~ (regex) !~ < <= > >=. Values are compared as
+// numbers if both sides are numbers, otherwise case sensitive as strings like
+// the server does. Fields in caseInsensitiveFields are compared case
+// insensitive because their case differs between the API versions.
+//
+// A value with , or ; is quoted with " or ', or the separator is escaped
+// with \. Separators inside {}, [] and () are kept, so regex values like
+// name=~^db-[0-9]{1,3} need no quotes.
+
+// filterClause is a single field operator value comparison
+type filterClause struct {
+	Field string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// filterExpr is a filter expression as or of and terms
+type filterExpr struct {
+	Or [][]filterClause
+}
+
+// filterOps are the operators ordered so that longer operators match first
+var filterOps = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+// caseInsensitiveFields are compared case insensitive
+var caseInsensitiveFields = map[string]bool{"power_state": true}
+
+// splitFilter splits s at sep outside of quotes, brackets and escapes. A
+// quote only starts a quoted value after an operator, so names like O'Neil
+// need no escape.
+func splitFilter(s string, sep byte) ([]string, error) {
+
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && afterOperator(s[start:i]):
+			quote = c
+		case c == '{' || c == '[' || c == '(':
+			depth++
+		case (c == '}' || c == ']' || c == ')') && depth > 0:
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in filter %q", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// afterOperator returns true if s ends with an operator and spaces
+func afterOperator(s string) bool {
+	s = strings.TrimRight(s, " ")
+	return s != "" && strings.IndexByte("=~<>", s[len(s)-1]) >= 0
+}
+
+// unquoteValue removes the quotes of a quoted value and the \ of escaped
+// separators and quotes. Other backslashes are kept for regular expressions.
+func unquoteValue(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return strings.NewReplacer(`\,`, ",", `\;`, ";", `\"`, `"`, `\'`, "'").Replace(s)
+}
+
+// parseFilter parses a filter expression, an empty expression matches everything
+func parseFilter(s string) (*filterExpr, error) {
+
+	f := &filterExpr{}
+	if strings.TrimSpace(s) == "" {
+		return f, nil
+	}
+
+	terms, err := splitFilter(s, ',')
+	if err != nil {
+		return nil, err
+	}
+	for _, term := range terms {
+		clauses, err := splitFilter(term, ';')
+		if err != nil {
+			return nil, err
+		}
+		var and []filterClause
+		for _, clause := range clauses {
+			cl, err := parseClause(strings.TrimSpace(clause))
+			if err != nil {
+				return nil, err
+			}
+			and = append(and, cl)
+		}
+		f.Or = append(f.Or, and)
+	}
+	return f, nil
+}
+
+// parseClause parses a single field operator value clause
+func parseClause(s string) (filterClause, error) {
+
+	best := -1
+	var op string
+	for _, o := range filterOps {
+		if i := strings.Index(s, o); i > 0 && (best < 0 || i < best || i == best && len(o) > len(op)) {
+			best, op = i, o
+		}
+	}
+	if best < 0 {
+		return filterClause{}, fmt.Errorf("invalid filter clause %q", s)
+	}
+
+	cl := filterClause{Field: strings.TrimSpace(s[:best]), Op: op, Value: unquoteValue(strings.TrimSpace(s[best+len(op):]))}
+	if cl.Op == "=~" || cl.Op == "!~" {
+		re, err := regexp.Compile(cl.Value)
+		if err != nil {
+			return filterClause{}, fmt.Errorf("invalid regex in %q: %v", s, err)
+		}
+		cl.re = re
+	}
+	return cl, nil
+}
+
+// match evaluates the clause against the flattened fields of a resource
+func (cl filterClause) match(fields map[string]interface{}) bool {
+
+	v, ok := fields[cl.Field]
+	if !ok {
+		return cl.Op == "!=" || cl.Op == "!~"
+	}
+	s := fmt.Sprint(v)
+
+	switch cl.Op {
+	case "=~":
+		return cl.re.MatchString(s)
+	case "!~":
+		return !cl.re.MatchString(s)
+	}
+
+	a, errA := strconv.ParseFloat(s, 64)
+	b, errB := strconv.ParseFloat(cl.Value, 64)
+	cmp := 0
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else if caseInsensitiveFields[cl.Field] {
+		cmp = strings.Compare(strings.ToLower(s), strings.ToLower(cl.Value))
+	} else {
+		cmp = strings.Compare(s, cl.Value)
+	}
+
+	switch cl.Op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// match evaluates the expression against a resource. The resource is
+// converted to JSON, so the v2 field names are used.
+func (f *filterExpr) match(resource interface{}) bool {
+
+	if len(f.Or) == 0 {
+		return true
+	}
+
+	data, _ := json.Marshal(resource)
+	var m interface{}
+	json.Unmarshal(data, &m)
+	fields := make(map[string]interface{})
+	flatten("", m, fields)
+
+	for _, and := range f.Or {
+		ok := true
+		for _, cl := range and {
+			if !cl.match(fields) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serverField describes how a field is filtered by the API versions. Fields
+// without an entry are only evaluated on the client.
+type serverField struct {
+	v1 string
+	v2 string
+	v3 string
+	// upper is set if v3 returns the values in upper case and v1 and v2 in
+	// lower case
+	upper bool
+}
+
+// serverFields are the VM fields Prism can filter on
+var serverFields = map[string]serverField{
+	"name":        {v1: "vm_name", v2: "vm_name", v3: "vm_name"},
+	"power_state": {v1: "power_state", v2: "power_state", v3: "power_state", upper: true},
+	"host_uuid":   {v1: "host_uuid", v2: "host_uuid"},
+}
+
+// capable returns true if the server can evaluate the clause. Only == and
+// != with values which need no quoting in FIQL are send to the server.
+func (cl filterClause) capable(api string) bool {
+	sf, ok := serverFields[cl.Field]
+	if !ok || cl.Op != "==" && cl.Op != "!=" || strings.ContainsAny(cl.Value, ",;") {
+		return false
+	}
+	return api == "v1" && sf.v1 != "" || api == "v2" && sf.v2 != "" || api == "v3" && sf.v3 != ""
+}
+
+// fiql compiles the clauses the server can evaluate into a FIQL string for
+// the v1 filterCriteria, v2 filter_criteria or the v3 filter. With several
+// or terms the expression is only send if the server can evaluate all
+// clauses, otherwise the server would drop matching resources.
+func (f *filterExpr) fiql(api string) string {
+
+	if len(f.Or) == 1 {
+		var clauses []filterClause
+		for _, cl := range f.Or[0] {
+			if cl.capable(api) {
+				clauses = append(clauses, cl)
+			}
+		}
+		return joinFIQL(clauses, api)
+	}
+
+	var terms []string
+	for _, and := range f.Or {
+		for _, cl := range and {
+			if !cl.capable(api) {
+				return ""
+			}
+		}
+		terms = append(terms, joinFIQL(and, api))
+	}
+	return strings.Join(terms, ",")
+}
+
+// joinFIQL joins the clauses with ; using the field names of the API
+func joinFIQL(clauses []filterClause, api string) string {
+	var parts []string
+	for _, cl := range clauses {
+		sf := serverFields[cl.Field]
+		name, value := sf.v2, cl.Value
+		switch api {
+		case "v1":
+			name = sf.v1
+		case "v3":
+			name = sf.v3
+			if sf.upper {
+				value = strings.ToUpper(value)
+			}
+		}
+		if sf.upper && api != "v3" {
+			value = strings.ToLower(value)
+		}
+		parts = append(parts, name+cl.Op+value)
+	}
+	return strings.Join(parts, ";")
+}
+
+// sortSpec is a sort by a v2 field, descending if the field starts with -
+type sortSpec struct {
+	Field      string
+	Descending bool
+}
+
+// parseSort parses a sort field like -memory_mb
+func parseSort(s string) sortSpec {
+	if strings.HasPrefix(s, "-") {
+		return sortSpec{Field: s[1:], Descending: true}
+	}
+	return sortSpec{Field: strings.TrimPrefix(s, "+")}
+}
+
+// query returns the v1 or v2 query parameters for the filter and sort
+func (f *filterExpr) query(api string, s sortSpec) url.Values {
+	q := url.Values{}
+	filterKey, sortKey := "filter_criteria", "sort_criteria"
+	if api == "v1" {
+		filterKey, sortKey = "filterCriteria", "sortCriteria"
+	}
+	if fiql := f.fiql(api); fiql != "" {
+		q.Set(filterKey, fiql)
+	}
+	if sf, ok := serverFields[s.Field]; ok {
+		name := sf.v2
+		if api == "v1" {
+			name = sf.v1
+		}
+		if s.Descending {
+			name = "-" + name
+		}
+		q.Set(sortKey, name)
+	}
+	return q
+}
+
+// v3Body returns the v3 list body for the filter and sort
+func (f *filterExpr) v3Body(kind string, s sortSpec, offset int) map[string]interface{} {
+	body := map[string]interface{}{"kind": kind, "length": 500, "offset": offset}
+	if fiql := f.fiql("v3"); fiql != "" {
+		body["filter"] = fiql
+	}
+	if sf, ok := serverFields[s.Field]; ok && sf.v3 != "" {
+		body["sort_attribute"] = sf.v3
+		body["sort_order"] = "ASCENDING"
+		if s.Descending {
+			body["sort_order"] = "DESCENDING"
+		}
+	}
+	return body
+}
+
+// vmsListV3Full is the part of the v3 /vms/list response converted into vm
+type vmsListV3Full struct {
+	Metadata struct {
+		TotalMatches int `json:"total_matches"`
+	} `json:"metadata"`
+	Entities []struct {
+		Metadata struct {
+			UUID string `json:"uuid"`
+		} `json:"metadata"`
+		Status struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Resources   struct {
+				PowerState        string `json:"power_state"`
+				NumSockets        int    `json:"num_sockets"`
+				NumVcpusPerSocket int    `json:"num_vcpus_per_socket"`
+				MemorySizeMib     int    `json:"memory_size_mib"`
+				HostReference     struct {
+					UUID string `json:"uuid"`
+				} `json:"host_reference"`
+			} `json:"resources"`
+		} `json:"status"`
+	} `json:"entities"`
+}
+
+// vmsGetV1 is the part of the v1 /vms response converted into vm
+type vmsGetV1 struct {
+	Entities []struct {
+		UUID                  string `json:"uuid"`
+		VMName                string `json:"vmName"`
+		PowerState            string `json:"powerState"`
+		NumVCpus              int    `json:"numVCpus"`
+		MemoryCapacityInBytes int64  `json:"memoryCapacityInBytes"`
+		HostUUID              string `json:"hostUuid"`
+		HostName              string `json:"hostName"`
+		ClusterUUID           string `json:"clusterUuid"`
+
+		// Stats are the performance stats, all values are send as strings
+		Stats map[string]string `json:"stats"`
+	} `json:"entities"`
+}
+
+// listVMsFiltered lists the VMs with the API version, sends the part of the
+// filter the server can evaluate and evaluates the whole filter on the
+// client. If the server rejects the filter the VMs are listed unfiltered.
+func (c *client) listVMsFiltered(f *filterExpr, s sortSpec, api string) ([]vm, error) {
+
+	vms, err := c.listVMsServer(f, s, api)
+	if _, ok := err.(*apiError); ok && (f.fiql(api) != "" || s.Field != "") {
+		vms, err = c.listVMsServer(&filterExpr{}, sortSpec{}, api)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []vm
+	for _, v := range vms {
+		if f.match(v) {
+			out = append(out, v)
+		}
+	}
+
+	if s.Field != "" {
+		sortResources(out, s)
+	}
+	return out, nil
+}
+
+// listVMsServer lists the VMs with the server side part of filter and sort
+func (c *client) listVMsServer(f *filterExpr, s sortSpec, api string) ([]vm, error) {
+
+	var vms []vm
+
+	switch api {
+	case "v1":
+		var resp vmsGetV1
+		if err := c.get(c.v1("/vms/?"+f.query("v1", s).Encode()), &resp); err != nil {
+			return nil, err
+		}
+		for _, e := range resp.Entities {
+			vms = append(vms, vm{UUID: e.UUID, Name: e.VMName, PowerState: strings.ToLower(e.PowerState),
+				NumVcpus: e.NumVCpus, NumCoresPerVcpu: 1, MemoryMB: int(e.MemoryCapacityInBytes >> 20), HostUUID: e.HostUUID})
+		}
+
+	case "v2":
+		q := f.query("v2", s)
+		q.Set("include_vm_disk_config", "true")
+		q.Set("include_vm_nic_config", "true")
+		var resp vmsGet
+		if err := c.get(c.v2("/vms/?"+q.Encode()), &resp); err != nil {
+			return nil, err
+		}
+		vms = resp.Entities
+
+	case "v3":
+		for offset := 0; ; {
+			var resp vmsListV3Full
+			if err := c.post(c.v3("/vms/list"), f.v3Body("vm", s, offset), &resp); err != nil {
+				return nil, err
+			}
+			for _, e := range resp.Entities {
+				r := e.Status.Resources
+				vms = append(vms, vm{UUID: e.Metadata.UUID, Name: e.Status.Name, Description: e.Status.Description,
+					PowerState: strings.ToLower(r.PowerState), NumVcpus: r.NumSockets, NumCoresPerVcpu: r.NumVcpusPerSocket,
+					MemoryMB: r.MemorySizeMib, HostUUID: r.HostReference.UUID})
+			}
+			offset += len(resp.Entities)
+			if len(resp.Entities) == 0 || offset >= resp.Metadata.TotalMatches {
+				break
+			}
+		}
+
+	default:
+		return nil, errors.New("unknown API " + api)
+	}
+
+	return vms, nil
+}
+
+// sortResources sorts the VMs by the v2 field of the sort
+func sortResources(vms []vm, s sortSpec) {
+
+	keys := make([]map[string]interface{}, len(vms))
+	for i := range vms {
+		data, _ := json.Marshal(vms[i])
+		var m interface{}
+		json.Unmarshal(data, &m)
+		keys[i] = make(map[string]interface{})
+		flatten("", m, keys[i])
+	}
+
+	idx := make([]int, len(vms))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		cl := filterClause{Field: s.Field, Op: "<", Value: fmt.Sprint(keys[idx[b]][s.Field])}
+		less := cl.match(keys[idx[a]])
+		if s.Descending {
+			cl.Op = ">"
+			return cl.match(keys[idx[a]])
+		}
+		return less
+	})
+
+	sorted := make([]vm, len(vms))
+	for i, j := range idx {
+		sorted[i] = vms[j]
+	}
+	copy(vms, sorted)
+}
+
+// runVMList is the "vm list" command
+func runVMList(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm list", flag.ExitOnError)
+	var expr = fs.String("filter", "", "filter expression, e.g. power_state==on;name=~^db-")
+	var sortBy = fs.String("sort", "name", "v2 field to sort by, prefix with - for descending")
+	var api = fs.String("api", "v2", "API used to list the VMs: v1, v2 or v3")
+	var explain = fs.Bool("explain", false, "print the server side filter of each API")
+	fs.Parse(args)
+
+	f, err := parseFilter(*expr)
+	if err != nil {
+		return err
+	}
+	s := parseSort(*sortBy)
+
+	if *explain {
+		fmt.Printf("v1 query: %s\n", f.query("v1", s).Encode())
+		fmt.Printf("v2 query: %s\n", f.query("v2", s).Encode())
+		body, _ := json.Marshal(f.v3Body("vm", s, 0))
+		fmt.Printf("v3 body:  %s\n", body)
+		return nil
+	}
+
+	vms, err := c.listVMsFiltered(f, s, *api)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-30s %-38s %-10s %6s %6s %10s\n", "NAME", "UUID", "POWER", "VCPUS", "CORES", "MEMORY_MB")
+	for _, v := range vms {
+		fmt.Printf("%-30s %-38s %-10s %6d %6d %10d\n", v.Name, v.UUID, v.PowerState, v.NumVcpus, v.NumCoresPerVcpu, v.MemoryMB)
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "vm list", usage: "list VMs with a filter expression and sort", run: runVMList})
+}
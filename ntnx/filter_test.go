@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+
+	for _, tt := range []struct {
+		in   string
+		want [][]filterClause
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "  ", want: nil},
+		{in: "power_state==on", want: [][]filterClause{{{Field: "power_state", Op: "==", Value: "on"}}}},
+		{in: "num_vcpus>=4,memory_mb>8192", want: [][]filterClause{
+			{{Field: "num_vcpus", Op: ">=", Value: "4"}},
+			{{Field: "memory_mb", Op: ">", Value: "8192"}},
+		}},
+		{in: "power_state==on; name!=db", want: [][]filterClause{{
+			{Field: "power_state", Op: "==", Value: "on"},
+			{Field: "name", Op: "!=", Value: "db"},
+		}}},
+		{in: "a<=1;b<2;c!~x", want: [][]filterClause{{
+			{Field: "a", Op: "<=", Value: "1"},
+			{Field: "b", Op: "<", Value: "2"},
+			{Field: "c", Op: "!~", Value: "x"},
+		}}},
+		{in: "name==a==b", want: [][]filterClause{{{Field: "name", Op: "==", Value: "a==b"}}}},
+		{in: "name=~^db-[0-9]{1,3}$;power_state==on", want: [][]filterClause{{
+			{Field: "name", Op: "=~", Value: "^db-[0-9]{1,3}$"},
+			{Field: "power_state", Op: "==", Value: "on"},
+		}}},
+		{in: `name=="a,b;c",description=='x, y'`, want: [][]filterClause{
+			{{Field: "name", Op: "==", Value: "a,b;c"}},
+			{{Field: "description", Op: "==", Value: "x, y"}},
+		}},
+		{in: `name==a\,b\;c`, want: [][]filterClause{{{Field: "name", Op: "==", Value: "a,b;c"}}}},
+		{in: `name=~^\d+\.x$`, want: [][]filterClause{{{Field: "name", Op: "=~", Value: `^\d+\.x$`}}}},
+		{in: "name==O'Neil,name==x", want: [][]filterClause{
+			{{Field: "name", Op: "==", Value: "O'Neil"}},
+			{{Field: "name", Op: "==", Value: "x"}},
+		}},
+		{in: `name=="a,b`, err: true},
+		{in: "name", err: true},
+		{in: "==on", err: true},
+		{in: "name=~[", err: true},
+	} {
+		f, err := parseFilter(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.in, f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		for _, and := range f.Or {
+			for i := range and {
+				and[i].re = nil
+			}
+		}
+		if !reflect.DeepEqual(f.Or, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.in, f.Or, tt.want)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+
+	v := map[string]interface{}{"name": "DB-01", "power_state": "on", "num_vcpus": 8, "memory_mb": 4096}
+	for _, tt := range []struct {
+		filter string
+		want   bool
+	}{
+		{"", true},
+		{"name=~^DB-", true},
+		{"name==DB-01", true},
+		{"name==db-01", false},
+		{"name!=db-01", true},
+		{"power_state==ON", true},
+		{"name=~^DB-[0-9]{1,3}$", true},
+		{"name!~^web", true},
+		{"num_vcpus>=4;memory_mb>8192", false},
+		{"num_vcpus>=4,memory_mb>8192", true},
+		{"num_vcpus<10", true},
+		{"num_vcpus==8.0", true},
+		{"missing!=x", true},
+		{"missing==x", false},
+	} {
+		f, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.filter, err)
+		}
+		if got := f.match(v); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestFilterFIQL(t *testing.T) {
+
+	for _, tt := range []struct {
+		filter string
+		api    string
+		want   string
+	}{
+		{"power_state==ON;name==web", "v2", "power_state==on;vm_name==web"},
+		{"power_state==on", "v3", "power_state==ON"},
+		{"name==web,name==db", "v1", "vm_name==web,vm_name==db"},
+		{"name==web;num_vcpus>2", "v2", "vm_name==web"},
+		{"name==web,num_vcpus>2", "v2", ""},
+		{`name=="a,b"`, "v2", ""},
+		{"name=~^web", "v2", ""},
+	} {
+		f, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.filter, err)
+		}
+		if got := f.fiql(tt.api); got != tt.want {
+			t.Errorf("%q %s: got %q, want %q", tt.filter, tt.api, got, tt.want)
+		}
+	}
+}
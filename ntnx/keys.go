@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// publicKey is an SSH public key trusted by the cluster
+type publicKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// material returns the type and the base64 part of the key, the comment is
+// ignored when keys are compared
+func (k publicKey) material() string {
+	fields := strings.Fields(k.Key)
+	if len(fields) < 2 {
+		return strings.TrimSpace(k.Key)
+	}
+	return fields[0] + " " + fields[1]
+}
+
+// listPublicKeys returns the public keys of the cluster
+func (c *client) listPublicKeys() ([]publicKey, error) {
+	var keys []publicKey
+	err := c.get(c.v1("/cluster/public_keys"), &keys)
+	return keys, err
+}
+
+// addPublicKey adds the key to the cluster
+func (c *client) addPublicKey(k publicKey) error {
+	return c.post(c.v1("/cluster/public_keys"), k, nil)
+}
+
+// removePublicKey removes the key name from the cluster
+func (c *client) removePublicKey(name string) error {
+	return c.delete(c.v1("/cluster/public_keys/"+url.PathEscape(name)), nil)
+}
+
+// keyTypes are the prefixes of the key types in authorized_keys files
+var keyTypes = []string{"ssh-", "ecdsa-", "sk-"}
+
+// isKeyType returns true if s is a key type like "ssh-ed25519"
+func isKeyType(s string) bool {
+	for _, t := range keyTypes {
+		if strings.HasPrefix(s, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyName returns a name the cluster accepts from the comment of the key or
+// the fingerprint if the key has no comment
+func keyName(comment string, material string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, comment)
+	if name != "" {
+		return name
+	}
+	fields := strings.Fields(material)
+	data, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+	sum := sha256.Sum256(data)
+	return "key-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// parseAuthorizedKeys parses an authorized_keys file. Options before the key
+// type are ignored, the comment is used as name.
+func parseAuthorizedKeys(data []byte) ([]publicKey, error) {
+	var keys []publicKey
+	names := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		i := 0
+		for i < len(fields) && !isKeyType(fields[i]) {
+			i++
+		}
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("line %d: no public key", num)
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[i+1]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid public key: %v", num, err)
+		}
+		material := fields[i] + " " + fields[i+1]
+		comment := strings.Join(fields[i+2:], " ")
+		k := publicKey{Name: keyName(comment, material), Key: strings.TrimSpace(material + " " + comment)}
+
+		// the names must be unique on the cluster
+		names[k.Name]++
+		if n := names[k.Name]; n > 1 {
+			k.Name = fmt.Sprintf("%s_%d", k.Name, n)
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+// keyChanges are the keys to add and to remove to sync the cluster. Keys
+// are added before keys are removed, so access is never lost. An added key
+// whose name is still used by a removed key is added with a temporary name
+// and renamed after the removal.
+type keyChanges struct {
+	Add    []publicKey
+	Remove []publicKey
+	Rename map[string]string // temporary name of an added key to its name
+}
+
+// diffKeys returns the changes to get from the cluster keys to the wanted
+// keys. Keys are compared by their material, a wanted key with the name of
+// a different cluster key replaces it. A key which is wanted more than once
+// is only added once. With keep no key is removed, so the names of all
+// cluster keys stay taken.
+func diffKeys(cluster []publicKey, wanted []publicKey, keep bool) keyChanges {
+
+	ch := keyChanges{Rename: make(map[string]string)}
+	have := make(map[string]publicKey)
+	for _, k := range cluster {
+		have[k.material()] = k
+	}
+	want := make(map[string]bool)
+	for _, k := range wanted {
+		if want[k.material()] {
+			continue
+		}
+		want[k.material()] = true
+		if _, ok := have[k.material()]; !ok {
+			ch.Add = append(ch.Add, k)
+		}
+	}
+
+	removed := make(map[string]bool)
+	for _, k := range cluster {
+		if !keep && !want[k.material()] {
+			ch.Remove = append(ch.Remove, k)
+			removed[k.Name] = true
+		}
+	}
+
+	// an added key gets the name of a removed key only after the removal,
+	// the names of the kept keys are never free
+	taken := make(map[string]bool)
+	for _, k := range cluster {
+		taken[k.Name] = true
+	}
+	for i, k := range ch.Add {
+		name := k.Name
+		for n := 2; taken[name] && !removed[name]; n++ {
+			name = fmt.Sprintf("%s_%d", k.Name, n)
+		}
+		delete(removed, name)
+		final := name
+		for n := 1; taken[name]; n++ {
+			name = fmt.Sprintf("%s_new%d", final, n)
+		}
+		if name != final {
+			ch.Rename[name] = final
+		}
+		ch.Add[i].Name = name
+		taken[name], taken[final] = true, true
+	}
+	return ch
+}
+
+// shortKey returns the type, the start of the key and the comment for display
+func shortKey(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return key
+	}
+	material := fields[1]
+	if len(material) > 16 {
+		material = material[:8] + "..." + material[len(material)-8:]
+	}
+	return strings.Join(append([]string{fields[0], material}, fields[2:]...), " ")
+}
+
+// runKeysList is the "keys list" command
+func runKeysList(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("keys list", flag.ExitOnError)
+	var jsonOut = fs.Bool("json", false, "print the keys as JSON")
+	fs.Parse(args)
+
+	all := make(map[string][]publicKey)
+	for _, cc := range c.all() {
+		keys, err := cc.listPublicKeys()
+		if err != nil {
+			return err
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+		all[cc.host] = keys
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(all)
+	}
+	for _, cc := range c.all() {
+		if len(c.peers) > 0 {
+			fmt.Printf("%s:\n", cc.host)
+		}
+		for _, k := range all[cc.host] {
+			fmt.Printf("  %-24s %s\n", k.Name, shortKey(k.Key))
+		}
+	}
+	return nil
+}
+
+// runKeysAdd is the "keys add" command
+func runKeysAdd(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("keys add", flag.ExitOnError)
+	var name = fs.String("name", "", "name of the key, the comment of the key if not set")
+	var key = fs.String("key", "", "public key like \"ssh-ed25519 AAAA... user@host\"")
+	var file = fs.String("f", "", "file with the public key like ~/.ssh/id_ed25519.pub")
+	fs.Parse(args)
+
+	text := *key
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	keys, err := parseAuthorizedKeys([]byte(text))
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 {
+		return errors.New("exactly one public key is required with -key or -f")
+	}
+	k := keys[0]
+	if *name != "" {
+		k.Name = *name
+	}
+
+	for _, cc := range c.all() {
+		if err := cc.addPublicKey(k); err != nil {
+			return err
+		}
+		fmt.Printf("%s: added %s\n", cc.host, k.Name)
+	}
+	return nil
+}
+
+// runKeysRemove is the "keys remove" command
+func runKeysRemove(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("keys remove", flag.ExitOnError)
+	var name = fs.String("name", "", "name of the key")
+	fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	for _, cc := range c.all() {
+		if err := cc.removePublicKey(*name); err != nil {
+			return err
+		}
+		fmt.Printf("%s: removed %s\n", cc.host, *name)
+	}
+	return nil
+}
+
+// runKeysSync is the "keys sync" command
+func runKeysSync(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("keys sync", flag.ExitOnError)
+	var file = fs.String("f", "", "authorized_keys file with the keys the clusters should trust")
+	var keep = fs.Bool("keep", false, "only add keys, keep the cluster keys which are not in the file")
+	var yes = fs.Bool("yes", false, "do not ask for confirmation")
+	var dryRun = fs.Bool("dry-run", false, "only print the changes")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-f is required")
+	}
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	wanted, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *file, err)
+	}
+
+	changes := make(map[*client]keyChanges)
+	total := 0
+	for _, cc := range c.all() {
+		keys, err := cc.listPublicKeys()
+		if err != nil {
+			return err
+		}
+		ch := diffKeys(keys, wanted, *keep)
+		changes[cc] = ch
+		total += len(ch.Add) + len(ch.Remove)
+
+		fmt.Printf("%s:\n", cc.host)
+		if len(ch.Add)+len(ch.Remove) == 0 {
+			fmt.Println("  in sync")
+		}
+		for _, k := range ch.Remove {
+			fmt.Printf("  - %-24s %s\n", k.Name, shortKey(k.Key))
+		}
+		for _, k := range ch.Add {
+			name := k.Name
+			if final, ok := ch.Rename[k.Name]; ok {
+				name = final
+			}
+			fmt.Printf("  + %-24s %s\n", name, shortKey(k.Key))
+		}
+	}
+
+	if total == 0 || *dryRun {
+		return nil
+	}
+	if !*yes && !confirm(fmt.Sprintf("Apply %d key changes?", total)) {
+		return errors.New("aborted")
+	}
+
+	// additions first so a failed sync never removes access, a replaced
+	// key gets its name back after the removals
+	for _, cc := range c.all() {
+		ch := changes[cc]
+		for _, k := range ch.Add {
+			if err := cc.addPublicKey(k); err != nil {
+				return err
+			}
+			fmt.Printf("%s: added %s\n", cc.host, k.Name)
+		}
+		for _, k := range ch.Remove {
+			if err := cc.removePublicKey(k.Name); err != nil {
+				return err
+			}
+			fmt.Printf("%s: removed %s\n", cc.host, k.Name)
+		}
+		for _, k := range ch.Add {
+			final, ok := ch.Rename[k.Name]
+			if !ok {
+				continue
+			}
+			if err := cc.addPublicKey(publicKey{Name: final, Key: k.Key}); err != nil {
+				return err
+			}
+			if err := cc.removePublicKey(k.Name); err != nil {
+				return err
+			}
+			fmt.Printf("%s: renamed %s to %s\n", cc.host, k.Name, final)
+		}
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "keys list", usage: "list the SSH public keys of the clusters", run: runKeysList})
+	register(command{name: "keys add", usage: "add an SSH public key to the clusters", run: runKeysAdd})
+	register(command{name: "keys remove", usage: "remove an SSH public key from the clusters", run: runKeysRemove})
+	register(command{name: "keys sync", usage: "sync the SSH public keys of the clusters with an authorized_keys file", run: runKeysSync})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffKeys(t *testing.T) {
+
+	alice := publicKey{Name: "alice", Key: "ssh-ed25519 QUxJQ0U= alice@a"}
+	bob := publicKey{Name: "bob", Key: "ssh-ed25519 Qk9C bob@b"}
+	names := func(keys []publicKey) []string {
+		out := []string{}
+		for _, k := range keys {
+			out = append(out, k.Name+" "+k.material())
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		name    string
+		cluster []publicKey
+		wanted  []publicKey
+		keep    bool
+		add     []string
+		remove  []string
+		rename  map[string]string
+	}{
+		{name: "in sync", cluster: []publicKey{alice, bob}, wanted: []publicKey{bob, alice},
+			add: []string{}, remove: []string{}, rename: map[string]string{}},
+		{name: "same material with another comment", cluster: []publicKey{alice},
+			wanted: []publicKey{{Name: "alice", Key: "ssh-ed25519 QUxJQ0U= other"}},
+			add:    []string{}, remove: []string{}, rename: map[string]string{}},
+		{name: "add and remove", cluster: []publicKey{alice}, wanted: []publicKey{bob},
+			add: []string{"bob ssh-ed25519 Qk9C"}, remove: []string{"alice ssh-ed25519 QUxJQ0U="}, rename: map[string]string{}},
+		{name: "wanted twice is added once", cluster: nil,
+			wanted: []publicKey{bob, {Name: "bob_2", Key: "ssh-ed25519 Qk9C copy"}},
+			add:    []string{"bob ssh-ed25519 Qk9C"}, remove: []string{}, rename: map[string]string{}},
+		{name: "replace is added with a temporary name", cluster: []publicKey{alice},
+			wanted: []publicKey{{Name: "alice", Key: "ssh-ed25519 TkVX alice@new"}},
+			add:    []string{"alice_new1 ssh-ed25519 TkVX"}, remove: []string{"alice ssh-ed25519 QUxJQ0U="},
+			rename: map[string]string{"alice_new1": "alice"}},
+		{name: "name of a kept key is not reused", cluster: []publicKey{alice},
+			wanted: []publicKey{{Name: "dave", Key: alice.Key}, {Name: "alice", Key: "ssh-ed25519 TkVX"}},
+			add:    []string{"alice_2 ssh-ed25519 TkVX"}, remove: []string{}, rename: map[string]string{}},
+		{name: "keep removes nothing and renames nothing", cluster: []publicKey{alice, bob},
+			wanted: []publicKey{{Name: "alice", Key: "ssh-ed25519 TkVX"}}, keep: true,
+			add: []string{"alice_2 ssh-ed25519 TkVX"}, remove: []string{}, rename: map[string]string{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := diffKeys(tt.cluster, tt.wanted, tt.keep)
+			if got := names(ch.Add); !reflect.DeepEqual(got, tt.add) {
+				t.Errorf("add %q, want %q", got, tt.add)
+			}
+			if got := names(ch.Remove); !reflect.DeepEqual(got, tt.remove) {
+				t.Errorf("remove %q, want %q", got, tt.remove)
+			}
+			if !reflect.DeepEqual(ch.Rename, tt.rename) {
+				t.Errorf("rename %v, want %v", ch.Rename, tt.rename)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// vmSelector describes how the VMs to operate on are chosen. Exactly one of
+// Name, Glob, Regex, UUID or Category has to be set. It is the same lookup
+// getVMInfo is using.
+type vmSelector struct {
+	Name     string
+	Glob     string
+	Regex    string
+	UUID     string
+	Category string
+	All      bool
+}
+
+// addFlags registers the selection flags on fs
+func (s *vmSelector) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.Name, "name", "", "exact name of the VM")
+	fs.StringVar(&s.Glob, "glob", "", "glob pattern matching the VM name, e.g. ci-*")
+	fs.StringVar(&s.Regex, "regex", "", "regular expression matching the VM name")
+	fs.StringVar(&s.UUID, "uuid", "", "UUID or UUID prefix of the VM")
+	fs.StringVar(&s.Category, "category", "", "v3 category of the VM as key:value")
+	fs.BoolVar(&s.All, "all", false, "operate on all matching VMs instead of failing if several match")
+}
+
+// describe returns a human readable form of the selector for error messages
+func (s vmSelector) describe() string {
+	switch {
+	case s.Name != "":
+		return "name " + s.Name
+	case s.Glob != "":
+		return "glob " + s.Glob
+	case s.Regex != "":
+		return "regex " + s.Regex
+	case s.UUID != "":
+		return "uuid prefix " + s.UUID
+	}
+	return "category " + s.Category
+}
+
+// validate makes sure exactly one selection criteria is set
+func (s vmSelector) validate() error {
+	n := 0
+	for _, v := range []string{s.Name, s.Glob, s.Regex, s.UUID, s.Category} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of -name, -glob, -regex, -uuid or -category is required")
+	}
+	if s.Category != "" && !strings.Contains(s.Category, ":") {
+		return errors.New("category has to be given as key:value")
+	}
+	return nil
+}
+
+// matches returns true if the VM matches the name, glob, regex or uuid prefix
+// of the selector
+func (s vmSelector) matches(v vm, re *regexp.Regexp) bool {
+	switch {
+	case s.Name != "":
+		return v.Name == s.Name
+	case s.Glob != "":
+		ok, _ := path.Match(s.Glob, v.Name)
+		return ok
+	case s.Regex != "":
+		return re.MatchString(v.Name)
+	case s.UUID != "":
+		return strings.HasPrefix(strings.ToLower(v.UUID), strings.ToLower(s.UUID))
+	}
+	return false
+}
+
+// vmsListV3 is the part of the v3 /vms/list response including the categories
+type vmsListV3 struct {
+	Metadata struct {
+		TotalMatches int `json:"total_matches"`
+	} `json:"metadata"`
+	Entities []struct {
+		Metadata struct {
+			UUID       string            `json:"uuid"`
+			Categories map[string]string `json:"categories"`
+		} `json:"metadata"`
+	} `json:"entities"`
+}
+
+// vmCategories returns the categories of all VMs by VM UUID. Categories are
+// only available with the v3 API.
+func (c *client) vmCategories() (map[string]map[string]string, error) {
+
+	categories := make(map[string]map[string]string)
+
+	// the v3 API is using POST with a JSON body to list entities page by page
+	for offset := 0; ; {
+		var resp vmsListV3
+		body := map[string]interface{}{"kind": "vm", "length": 500, "offset": offset}
+		if err := c.post(c.v3("/vms/list"), body, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, e := range resp.Entities {
+			categories[e.Metadata.UUID] = e.Metadata.Categories
+		}
+
+		offset += len(resp.Entities)
+		if len(resp.Entities) == 0 || offset >= resp.Metadata.TotalMatches {
+			return categories, nil
+		}
+	}
+}
+
+// filterVMs returns all VMs of vms matching the selector
+func (c *client) filterVMs(vms []vm, s vmSelector) ([]vm, error) {
+
+	var re *regexp.Regexp
+	if s.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(s.Regex); err != nil {
+			return nil, err
+		}
+	}
+
+	var categories map[string]map[string]string
+	if s.Category != "" {
+		var err error
+		if categories, err = c.vmCategories(); err != nil {
+			return nil, err
+		}
+	}
+	kv := strings.SplitN(s.Category, ":", 2)
+
+	var matched []vm
+	for _, v := range vms {
+		if s.Category != "" {
+			if value, ok := categories[v.UUID][kv[0]]; ok && value == kv[1] {
+				matched = append(matched, v)
+			}
+		} else if s.matches(v, re) {
+			matched = append(matched, v)
+		}
+	}
+
+	return matched, nil
+}
+
+// selectVMs returns all VMs matching the selector. It fails if no VM matches
+// or if several VMs match and the selector does not allow all.
+func (c *client) selectVMs(s vmSelector) ([]vm, error) {
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	vms, err := c.listVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := c.filterVMs(vms, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matched) == 0 {
+		return nil, errors.New("no VM found for " + s.describe())
+	}
+
+	if len(matched) > 1 && !s.All {
+		var names []string
+		for _, v := range matched {
+			names = append(names, fmt.Sprintf("%s (%s)", v.Name, v.UUID))
+		}
+		return nil, fmt.Errorf("%d VMs found for %s, use -all to select all of them:\n  %s",
+			len(matched), s.describe(), strings.Join(names, "\n  "))
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,109 @@
+// ntnx is a command line tool to manage VMs and clusters with the Nutanix
+// REST API. It is build from the same building blocks as the examples in this
+// repository.
+//
+// Usage:
+//
+//	ntnx [-host host] [-username user] [-password password] <command> [flags]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a sub command of ntnx like "vm power"
+type command struct {
+	name  string
+	usage string
+	run   func(c *client, args []string) error
+}
+
+// commands holds all sub commands. Each file registers its commands in init.
+var commands = make(map[string]command)
+
+// register adds the command cmd
+func register(cmd command) {
+	commands[cmd.name] = cmd
+}
+
+// getenv returns the value of the environment variable key or def if not set
+func getenv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// usage prints all known commands
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ntnx [global flags] <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Global flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, commands[name].usage)
+	}
+}
+
+// lookupCommand finds the command by the first one or two arguments and
+// returns the remaining arguments
+func lookupCommand(args []string) (command, []string, bool) {
+	if len(args) >= 2 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return cmd, args[2:], true
+		}
+	}
+	if len(args) >= 1 {
+		if cmd, ok := commands[args[0]]; ok {
+			return cmd, args[1:], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func main() {
+
+	// PRISM user
+	var username = flag.String("username", getenv("NUTANIX_USERNAME", "admin"), "PRISM user ($NUTANIX_USERNAME)")
+	// PRISM user password
+	var password = flag.String("password", getenv("NUTANIX_PASSWORD", "nutanix/4u"), "PRISM user password ($NUTANIX_PASSWORD)")
+	// Nutanix Cluster IP/DNSName CVM IP/DNSName
+	var NutanixHost = flag.String("host", getenv("NUTANIX_HOST", "192.168.178.130"), "Nutanix cluster or CVM IP/DNS name, comma separated for reports on several clusters ($NUTANIX_HOST)")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, args, ok := lookupCommand(flag.Args())
+	if !ok {
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "unknown command:", strings.Join(flag.Args(), " "))
+		}
+		usage()
+		os.Exit(2)
+	}
+
+	hosts := strings.Split(*NutanixHost, ",")
+	c := newClient(strings.TrimSpace(hosts[0]), *username, *password)
+	for _, h := range hosts[1:] {
+		c.peers = append(c.peers, newClient(strings.TrimSpace(h), *username, *password))
+	}
+
+	if err := cmd.run(c, args); err != nil {
+		fmt.Fprintln(os.Stderr, "ntnx "+cmd.name+":", err)
+		os.Exit(1)
+	}
+
+}
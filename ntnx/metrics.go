@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// metricSample is a single stat of a cluster, host, VM or container. Prism
+// computes all stats over its last sampling window, so every sample is a
+// gauge, counts like "controller_num_io" included.
+type metricSample struct {
+	Kind   string            // cluster, host, vm or container
+	Name   string            // stat name as send by the API like "storage.usage_bytes"
+	Labels map[string]string // cluster, host, vm or container names and UUIDs, always with the cluster UUID
+	Value  float64
+}
+
+// metricScrape are the samples of a Prism host
+type metricScrape struct {
+	Host     string
+	Time     time.Time
+	Duration time.Duration
+	Samples  []metricSample
+	Err      error
+}
+
+// appendStats appends a sample for every available stat. The API sends
+// the stats as strings and -1 for unavailable stats.
+func appendStats(samples []metricSample, kind string, labels map[string]string, stats map[string]string) []metricSample {
+	var names []string
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := statValue(stats[name]); v != -1 {
+			samples = append(samples, metricSample{Kind: kind, Name: name, Labels: labels, Value: float64(v)})
+		}
+	}
+	return samples
+}
+
+// collectMetrics returns the stats of all clusters, hosts, VMs and storage
+// containers of the host
+func (c *client) collectMetrics() ([]metricSample, error) {
+
+	clusters, err := c.listClusters()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := c.listHosts()
+	if err != nil {
+		return nil, err
+	}
+	var vms vmsGetV1
+	if err := c.get(c.v1("/vms/"), &vms); err != nil {
+		return nil, err
+	}
+	containers, err := c.listStorageContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	// a Prism Element may not send the cluster UUID with every entity, the
+	// entities belong to its single cluster then
+	names := make(map[string]string)
+	for _, ci := range clusters {
+		names[ci.UUID] = ci.Name
+	}
+	clusterLabels := func(uuid string) map[string]string {
+		name, ok := names[uuid]
+		switch {
+		case ok:
+		case len(clusters) == 1:
+			name, uuid = clusters[0].Name, clusters[0].UUID
+		default:
+			name = uuid
+		}
+		return map[string]string{"cluster": name, "cluster_uuid": uuid}
+	}
+
+	var samples []metricSample
+	for _, ci := range clusters {
+		labels := map[string]string{"cluster": ci.Name, "cluster_uuid": ci.UUID}
+		samples = append(samples, metricSample{Kind: "cluster", Name: "num_nodes", Labels: labels, Value: float64(ci.NumNodes)})
+		samples = appendStats(samples, "cluster", labels, ci.Stats.values())
+		samples = appendStats(samples, "cluster", labels, ci.UsageStats.values())
+	}
+	hostNames := make(map[string]string)
+	for _, h := range hosts {
+		hostNames[h.UUID] = h.Name
+		labels := clusterLabels(h.ClusterUUID)
+		labels["host"], labels["host_uuid"], labels["hypervisor"] = h.Name, h.UUID, h.HypervisorType
+		samples = appendStats(samples, "host", labels, h.Stats)
+		samples = appendStats(samples, "host", labels, h.UsageStats)
+	}
+	for _, v := range vms.Entities {
+		hostName := v.HostName
+		if hostName == "" {
+			hostName = hostNames[v.HostUUID]
+		}
+		labels := clusterLabels(v.ClusterUUID)
+		labels["host"], labels["vm"], labels["vm_uuid"] = hostName, v.VMName, v.UUID
+		samples = appendStats(samples, "vm", labels, v.Stats)
+	}
+	for _, sc := range containers {
+		labels := clusterLabels(sc.ClusterUUID)
+		labels["container"], labels["container_uuid"] = sc.Name, sc.UUID
+		samples = appendStats(samples, "container", labels, sc.UsageStats)
+	}
+	return samples, nil
+}
+
+// scrapeMetrics collects the metrics of the client and its peers. A failing
+// host does not stop the others.
+func (c *client) scrapeMetrics() []metricScrape {
+	var scrapes []metricScrape
+	for _, cc := range c.all() {
+		start := time.Now()
+		samples, err := cc.collectMetrics()
+		scrapes = append(scrapes, metricScrape{Host: cc.host, Time: start, Duration: time.Since(start), Samples: samples, Err: err})
+	}
+	return scrapes
+}
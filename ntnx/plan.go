@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// networkManifest describes a network in a manifest
+//
+//	kind: Network
+//	name: vlan10
+//	vlan_id: 10
+//	network_address: 10.10.0.0
+//	prefix_length: 24
+//	default_gateway: 10.10.0.1
+type networkManifest struct {
+	Kind           string `json:"kind"`
+	Name           string `json:"name"`
+	VlanID         int    `json:"vlan_id"`
+	NetworkAddress string `json:"network_address"`
+	PrefixLength   int    `json:"prefix_length"`
+	DefaultGateway string `json:"default_gateway"`
+}
+
+// imageManifest describes an image of the image service in a manifest
+//
+//	kind: Image
+//	name: centos7
+//	image_type: disk
+//	source_url: http://images.example.com/centos7.qcow2
+//	container: default-container
+type imageManifest struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	ImageType  string `json:"image_type"`
+	SourceURL  string `json:"source_url"`
+	Container  string `json:"container"`
+	Annotation string `json:"annotation"`
+}
+
+// vmManifest describes a VM in a manifest with the fields of the "vm create"
+// spec file and kind: VM
+type vmManifest struct {
+	Kind string `json:"kind"`
+	vmSpec
+}
+
+// manifests are all resources read from a manifest directory
+type manifests struct {
+	networks []networkManifest
+	images   []imageManifest
+	vms      []vmManifest
+}
+
+// imageTypes maps the image_type of a manifest to the v2 image type
+var imageTypes = map[string]string{
+	"disk": "DISK_IMAGE",
+	"iso":  "ISO_IMAGE",
+}
+
+// readManifests reads all .yaml, .yml and .json files below dir. A YAML file
+// may contain several resources separated by ---.
+func readManifests(dir string) (*manifests, error) {
+
+	m := &manifests{}
+	seen := make(map[string]string)
+
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		if ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		docs := [][]byte{data}
+		if ext != ".json" {
+			docs = nil
+			for _, doc := range splitDocuments(data) {
+				js, err := yamlManifest(doc)
+				if err != nil {
+					return fmt.Errorf("%s: %v", file, err)
+				}
+				docs = append(docs, js)
+			}
+		}
+
+		for _, doc := range docs {
+			kind, name, err := m.add(file, doc)
+			if err != nil {
+				return err
+			}
+			key := kind + "/" + name
+			if other, ok := seen[key]; ok {
+				return fmt.Errorf("%s: %s %q is already defined in %s", file, kind, name, other)
+			}
+			seen[key] = file
+		}
+		return nil
+	})
+
+	return m, err
+}
+
+// manifestKinds are the types of the manifests by kind
+var manifestKinds = map[string]interface{}{
+	"Network": networkManifest{},
+	"Image":   imageManifest{},
+	"VM":      vmManifest{},
+}
+
+// yamlManifest converts the YAML document into JSON typed by the manifest of
+// its kind
+func yamlManifest(doc []byte) ([]byte, error) {
+	var head struct {
+		Kind string `json:"kind"`
+	}
+	js, err := yamlToJSON(doc, &head)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(js, &head); err != nil {
+		return nil, err
+	}
+	return yamlToJSON(doc, manifestKinds[head.Kind])
+}
+
+// add decodes the JSON document by its kind and adds it to the manifests
+func (m *manifests) add(file string, doc []byte) (string, string, error) {
+
+	var head struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(doc, &head); err != nil {
+		return "", "", fmt.Errorf("%s: %v", file, err)
+	}
+	if head.Name == "" {
+		return "", "", fmt.Errorf("%s: name is required", file)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+
+	var err error
+	switch head.Kind {
+	case "Network":
+		var n networkManifest
+		if err = dec.Decode(&n); err == nil {
+			m.networks = append(m.networks, n)
+		}
+	case "Image":
+		var i imageManifest
+		if err = dec.Decode(&i); err == nil {
+			m.images = append(m.images, i)
+		}
+	case "VM":
+		var v vmManifest
+		if err = dec.Decode(&v); err == nil {
+			err = v.readUserdata(filepath.Dir(file))
+			m.vms = append(m.vms, v)
+		}
+	default:
+		err = fmt.Errorf("unknown kind %q, use Network, Image or VM", head.Kind)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s %s: %v", file, head.Kind, head.Name, err)
+	}
+	return head.Kind, head.Name, nil
+}
+
+// fieldChange is the change of a single field of a resource
+type fieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// change is a single create, update, replace or delete of the plan
+type change struct {
+	Action string
+	Kind   string
+	Name   string
+	Fields []fieldChange
+	Notes  []string
+	apply  func() (string, error)
+}
+
+// plan is the ordered list of changes. Creates and updates come first in the
+// order networks, images, VMs and deletes follow in the reverse order.
+type plan struct {
+	changes []*change
+}
+
+// knownAfterApply is used for UUIDs of resources which are created by the plan
+const knownAfterApply = "(known after apply)"
+
+// planOptions are the options of plan and apply
+type planOptions struct {
+	Dir             string
+	Prune           bool
+	PruneGlob       string
+	AllowPowerCycle bool
+	Timeout         time.Duration
+}
+
+// addFlags registers the plan flags on fs
+func (o *planOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Dir, "d", ".", "directory with the manifests")
+	fs.BoolVar(&o.Prune, "prune", false, "delete networks, images, VMs and disks which are not in the manifests, requires -prune-glob")
+	fs.StringVar(&o.PruneGlob, "prune-glob", "", "only prune resources with names matching this glob, e.g. ci-*")
+	fs.BoolVar(&o.AllowPowerCycle, "allow-power-cycle", false, "power cycle VMs if a change can not be hot-added")
+	fs.DurationVar(&o.Timeout, "timeout", 15*time.Minute, "time to wait for each task")
+}
+
+// validate makes sure -prune is limited to the resources of the manifests
+func (o planOptions) validate() error {
+	if o.Prune && o.PruneGlob == "" {
+		return errors.New("-prune requires -prune-glob to select the resources which may be deleted")
+	}
+	if _, err := path.Match(o.PruneGlob, ""); err != nil {
+		return fmt.Errorf("invalid -prune-glob: %v", err)
+	}
+	return nil
+}
+
+// pruned returns true if the unmanaged resource name has to be deleted
+func (o planOptions) pruned(name string) bool {
+	if !o.Prune {
+		return false
+	}
+	ok, _ := path.Match(o.PruneGlob, name)
+	return ok
+}
+
+// makePlan compares the manifests with the live state of the cluster
+func (c *client) makePlan(m *manifests, o planOptions) (*plan, error) {
+
+	r, err := c.loadResources()
+	if err != nil {
+		return nil, err
+	}
+	vms, err := c.listVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	// the VMs are validated against the live resources and the resources
+	// the plan is going to create
+	planned := &resources{
+		images:     append([]image(nil), r.images...),
+		containers: r.containers,
+		networks:   append([]network(nil), r.networks...),
+	}
+
+	p := &plan{}
+	var deletes []*change
+	var errs []error
+
+	// a network can only be deleted if no VM is attached. A replace runs
+	// before the VMs are pruned, a prune after, so the pruned VMs only
+	// block a replace.
+	managedVMs := make(map[string]bool)
+	for _, v := range m.vms {
+		managedVMs[v.Name] = true
+	}
+	attached := make(map[string][]string)
+	attachedAfterPrune := make(map[string][]string)
+	for _, v := range vms {
+		for _, nic := range v.VMNics {
+			attached[nic.NetworkUUID] = append(attached[nic.NetworkUUID], v.Name)
+			if managedVMs[v.Name] || !o.pruned(v.Name) {
+				attachedAfterPrune[nic.NetworkUUID] = append(attachedAfterPrune[nic.NetworkUUID], v.Name)
+			}
+		}
+	}
+
+	// networks
+	managed := make(map[string]bool)
+	for _, n := range m.networks {
+		managed[n.Name] = true
+		errs = append(errs, n.validate()...)
+
+		live, err := r.network(n.Name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		if live == nil {
+			nw := network{UUID: knownAfterApply, Name: n.Name, VlanID: n.VlanID}
+			nw.IPConfig.NetworkAddress = n.NetworkAddress
+			nw.IPConfig.PrefixLength = n.PrefixLength
+			planned.networks = append(planned.networks, nw)
+			p.add(&change{Action: "create", Kind: "Network", Name: n.Name, Fields: n.diff(nil), apply: c.applyNetwork(n, "", false)})
+			continue
+		}
+		if fields := n.diff(live); len(fields) > 0 {
+			// the IP config is used to validate static IPs of the VMs
+			for i := range planned.networks {
+				if planned.networks[i].UUID == live.UUID {
+					planned.networks[i].IPConfig.NetworkAddress = n.NetworkAddress
+					planned.networks[i].IPConfig.PrefixLength = n.PrefixLength
+				}
+			}
+
+			// the VLAN of a network can only be set on create
+			action := "update"
+			for _, f := range fields {
+				if f.Field == "vlan_id" {
+					action = "replace"
+				}
+			}
+			if names := attached[live.UUID]; action == "replace" && len(names) > 0 {
+				errs = append(errs, fmt.Errorf("Network %s: the VLAN change replaces the network, but VMs are attached: %s", n.Name, strings.Join(names, ", ")))
+				continue
+			}
+			p.add(&change{Action: action, Kind: "Network", Name: n.Name, Fields: fields, apply: c.applyNetwork(n, live.UUID, action == "replace")})
+		}
+	}
+	for _, live := range r.networks {
+		if !managed[live.Name] && o.pruned(live.Name) {
+			if names := attachedAfterPrune[live.UUID]; len(names) > 0 {
+				errs = append(errs, fmt.Errorf("Network %s: can not be pruned, VMs are attached: %s", live.Name, strings.Join(names, ", ")))
+				continue
+			}
+			uuid := live.UUID
+			deletes = append(deletes, &change{Action: "delete", Kind: "Network", Name: live.Name, apply: func() (string, error) {
+				return "deleted", c.delete(c.v2("/networks/"+uuid), nil)
+			}})
+		}
+	}
+
+	// images
+	containerNames := make(map[string]string)
+	for _, sc := range r.containers {
+		containerNames[sc.UUID] = sc.Name
+	}
+	managed = make(map[string]bool)
+	var imageDeletes []*change
+	for _, i := range m.images {
+		managed[i.Name] = true
+		errs = append(errs, i.validate(r)...)
+
+		live, err := r.image(i.Name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		if live == nil {
+			planned.images = append(planned.images, image{UUID: knownAfterApply, Name: i.Name,
+				ImageType: imageTypes[i.ImageType], VMDiskID: knownAfterApply})
+			p.add(&change{Action: "create", Kind: "Image", Name: i.Name, Fields: i.diff(nil, containerNames), apply: c.applyImage(i, "", false, o.Timeout)})
+			continue
+		}
+		fields := i.diff(live, containerNames)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// only the annotation can be changed, all other changes require a new image
+		action := "update"
+		for _, f := range fields {
+			if f.Field != "annotation" {
+				action = "replace"
+			}
+		}
+		p.add(&change{Action: action, Kind: "Image", Name: i.Name, Fields: fields, apply: c.applyImage(i, live.UUID, action == "replace", o.Timeout)})
+	}
+	for _, live := range r.images {
+		if !managed[live.Name] && o.pruned(live.Name) {
+			uuid := live.UUID
+			imageDeletes = append(imageDeletes, &change{Action: "delete", Kind: "Image", Name: live.Name, apply: func() (string, error) {
+				var resp taskResponse
+				if err := c.delete(c.v2("/images/"+uuid), &resp); err != nil {
+					return "", err
+				}
+				_, err := c.waitTask(resp.TaskUUID, o.Timeout)
+				return "deleted", err
+			}})
+		}
+	}
+	deletes = append(imageDeletes, deletes...)
+
+	// VMs
+	networkNames := make(map[string]string)
+	for _, n := range r.networks {
+		networkNames[n.UUID] = n.Name
+	}
+	managed = make(map[string]bool)
+	var vmDeletes []*change
+	for _, v := range m.vms {
+		managed[v.Name] = true
+		for _, err := range v.validate(planned, nil) {
+			errs = append(errs, fmt.Errorf("VM %s: %v", v.Name, err))
+		}
+
+		var live []vm
+		for _, l := range vms {
+			if l.Name == v.Name {
+				live = append(live, l)
+			}
+		}
+		switch len(live) {
+		case 0:
+			p.add(&change{Action: "create", Kind: "VM", Name: v.Name, Fields: v.diff(nil, networkNames, planned, o).Fields, apply: c.applyVMCreate(v.vmSpec, o)})
+		case 1:
+			ch := v.diff(&live[0], networkNames, planned, o)
+			if len(ch.Fields) > 0 || len(ch.Notes) > 0 {
+				ch.apply = c.applyVMUpdate(v.vmSpec, live[0], o)
+				p.add(ch)
+			}
+		default:
+			errs = append(errs, fmt.Errorf("VM %s: %d VMs with this name exist", v.Name, len(live)))
+		}
+	}
+	for _, live := range vms {
+		if !managed[live.Name] && o.pruned(live.Name) {
+			uuid := live.UUID
+			vmDeletes = append(vmDeletes, &change{Action: "delete", Kind: "VM", Name: live.Name, apply: func() (string, error) {
+				return "deleted", c.deleteVM(uuid, true, o.Timeout)
+			}})
+		}
+	}
+	deletes = append(vmDeletes, deletes...)
+
+	if err := joinErrors(errs); err != nil {
+		return nil, err
+	}
+
+	p.changes = append(p.changes, deletes...)
+	return p, nil
+}
+
+// add appends the change to the plan
+func (p *plan) add(ch *change) {
+	p.changes = append(p.changes, ch)
+}
+
+// print prints the plan and a summary line
+func (p *plan) print() {
+
+	symbols := map[string]string{"create": "+", "update": "~", "replace": "-/+", "delete": "-"}
+	count := make(map[string]int)
+
+	for _, ch := range p.changes {
+		count[ch.Action]++
+		fmt.Printf("%s %s %s %s\n", symbols[ch.Action], ch.Action, strings.ToLower(ch.Kind), ch.Name)
+		for _, f := range ch.Fields {
+			if ch.Action == "create" {
+				fmt.Printf("      %s: %s\n", f.Field, f.New)
+			} else {
+				fmt.Printf("      %s: %s -> %s\n", f.Field, orNone(f.Old), orNone(f.New))
+			}
+		}
+		for _, n := range ch.Notes {
+			fmt.Printf("      ! %s\n", n)
+		}
+	}
+
+	if len(p.changes) == 0 {
+		fmt.Println("No changes, the cluster matches the manifests.")
+		return
+	}
+	fmt.Printf("Plan: %d to create, %d to update, %d to replace, %d to delete.\n",
+		count["create"], count["update"], count["replace"], count["delete"])
+}
+
+// orNone returns (none) for empty values of the plan
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// validate checks the network manifest
+func (n networkManifest) validate() []error {
+	var errs []error
+	if n.VlanID < 0 || n.VlanID > 4095 {
+		errs = append(errs, fmt.Errorf("network %s: vlan_id %d is not between 0 and 4095", n.Name, n.VlanID))
+	}
+	if n.NetworkAddress != "" && (n.PrefixLength < 1 || n.PrefixLength > 32) {
+		errs = append(errs, fmt.Errorf("network %s: prefix_length is required with network_address", n.Name))
+	}
+	return errs
+}
+
+// diff returns the field changes between the manifest and the live network
+func (n networkManifest) diff(live *network) []fieldChange {
+	var fields []fieldChange
+	var l network
+	if live != nil {
+		l = *live
+	}
+	add := func(field string, old string, new string) {
+		if old != new {
+			fields = append(fields, fieldChange{field, old, new})
+		}
+	}
+	add("vlan_id", strconv.Itoa(l.VlanID), strconv.Itoa(n.VlanID))
+	add("network_address", l.IPConfig.NetworkAddress, n.NetworkAddress)
+	add("prefix_length", strconv.Itoa(l.IPConfig.PrefixLength), strconv.Itoa(n.PrefixLength))
+	add("default_gateway", l.IPConfig.DefaultGateway, n.DefaultGateway)
+	return fields
+}
+
+// applyNetwork creates the network, replaces it or updates the network with the uuid
+func (c *client) applyNetwork(n networkManifest, uuid string, replace bool) func() (string, error) {
+	return func() (string, error) {
+		if replace {
+			if err := c.delete(c.v2("/networks/"+uuid), nil); err != nil {
+				return "", err
+			}
+			uuid = ""
+		}
+		body := map[string]interface{}{"name": n.Name, "vlan_id": n.VlanID}
+		if n.NetworkAddress != "" {
+			body["ip_config"] = map[string]interface{}{
+				"network_address": n.NetworkAddress,
+				"prefix_length":   n.PrefixLength,
+				"default_gateway": n.DefaultGateway,
+			}
+		}
+		if uuid == "" {
+			var resp struct {
+				NetworkUUID string `json:"network_uuid"`
+			}
+			if err := c.post(c.v2("/networks/"), body, &resp); err != nil {
+				return "", err
+			}
+			return "created " + resp.NetworkUUID, nil
+		}
+		body["uuid"] = uuid
+		return "updated", c.put(c.v2("/networks/"+uuid), body, nil)
+	}
+}
+
+// validate checks the image manifest against the containers
+func (i imageManifest) validate(r *resources) []error {
+	var errs []error
+	if _, ok := imageTypes[i.ImageType]; !ok {
+		errs = append(errs, fmt.Errorf("image %s: image_type has to be disk or iso", i.Name))
+	}
+	if i.SourceURL == "" {
+		errs = append(errs, fmt.Errorf("image %s: source_url is required", i.Name))
+	}
+	if i.Container != "" {
+		if _, err := r.container(i.Container); err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %v", i.Name, err))
+		}
+	}
+	return errs
+}
+
+// diff returns the field changes between the manifest and the live image. The
+// source URL is not returned by the API and only shown on create.
+func (i imageManifest) diff(live *image, containerNames map[string]string) []fieldChange {
+	if live == nil {
+		return []fieldChange{
+			{"image_type", "", i.ImageType},
+			{"source_url", "", i.SourceURL},
+			{"container", "", i.Container},
+		}
+	}
+	var fields []fieldChange
+	if i.Annotation != live.Annotation {
+		fields = append(fields, fieldChange{"annotation", live.Annotation, i.Annotation})
+	}
+	if imageTypes[i.ImageType] != live.ImageType {
+		fields = append(fields, fieldChange{"image_type", live.ImageType, imageTypes[i.ImageType]})
+	}
+	if i.Container != "" && containerNames[live.StorageContainerUUID] != i.Container {
+		fields = append(fields, fieldChange{"container", containerNames[live.StorageContainerUUID], i.Container})
+	}
+	return fields
+}
+
+// applyImage creates the image, replaces it or updates its annotation and
+// waits up to timeout for each task
+func (c *client) applyImage(i imageManifest, uuid string, replace bool, timeout time.Duration) func() (string, error) {
+	return func() (string, error) {
+		var resp taskResponse
+
+		if uuid != "" && !replace {
+			body := map[string]string{"name": i.Name, "annotation": i.Annotation}
+			if err := c.put(c.v2("/images/"+uuid), body, &resp); err != nil {
+				return "", err
+			}
+			_, err := c.waitTask(resp.TaskUUID, timeout)
+			return "updated", err
+		}
+
+		if replace {
+			if err := c.delete(c.v2("/images/"+uuid), &resp); err != nil {
+				return "", err
+			}
+			if _, err := c.waitTask(resp.TaskUUID, timeout); err != nil {
+				return "", err
+			}
+		}
+
+		body := map[string]interface{}{
+			"name":       i.Name,
+			"annotation": i.Annotation,
+			"image_type": imageTypes[i.ImageType],
+			"image_import_spec": map[string]string{
+				"storage_container_name": i.Container,
+				"url":                    i.SourceURL,
+			},
+		}
+		if err := c.post(c.v2("/images/"), body, &resp); err != nil {
+			return "", err
+		}
+		t, err := c.waitTask(resp.TaskUUID, timeout)
+		if err != nil {
+			return "", err
+		}
+		if replace {
+			return "replaced (task " + t.UUID + ")", nil
+		}
+		return "created (task " + t.UUID + ")", nil
+	}
+}
+
+// diff returns the changes between the manifest and the live VM. Without a
+// live VM the fields of the new VM are returned.
+func (v vmManifest) diff(live *vm, networkNames map[string]string, r *resources, o planOptions) *change {
+
+	ch := &change{Action: "update", Kind: "VM", Name: v.Name}
+	cores := v.CoresPerVcpu
+	if cores == 0 {
+		cores = 1
+	}
+
+	if live == nil {
+		ch.Fields = []fieldChange{
+			{"vcpus", "", strconv.Itoa(v.Vcpus)},
+			{"cores_per_vcpu", "", strconv.Itoa(cores)},
+			{"memory_mb", "", strconv.Itoa(v.MemoryMB)},
+			{"disks", "", strconv.Itoa(len(v.Disks))},
+			{"nics", "", strconv.Itoa(len(v.Nics))},
+		}
+		return ch
+	}
+
+	add := func(field string, old string, new string) {
+		if old != new {
+			ch.Fields = append(ch.Fields, fieldChange{field, old, new})
+		}
+	}
+	add("description", live.Description, v.Description)
+	add("vcpus", strconv.Itoa(live.NumVcpus), strconv.Itoa(v.Vcpus))
+	add("cores_per_vcpu", strconv.Itoa(live.NumCoresPerVcpu), strconv.Itoa(cores))
+	add("memory_mb", strconv.Itoa(live.MemoryMB), strconv.Itoa(v.MemoryMB))
+
+	for i := 0; i < len(v.Nics) || i < len(live.VMNics); i++ {
+		field := fmt.Sprintf("nics[%d]", i)
+		switch {
+		case i >= len(live.VMNics):
+			add(field, "", v.Nics[i].Network+" "+v.Nics[i].IP)
+		case i >= len(v.Nics):
+			add(field, networkNames[live.VMNics[i].NetworkUUID], "")
+		default:
+			add(field+".network", networkNames[live.VMNics[i].NetworkUUID], v.Nics[i].Network)
+			if v.Nics[i].IP != "" {
+				add(field+".ip", live.VMNics[i].RequestedIPAddress, v.Nics[i].IP)
+			}
+		}
+	}
+
+	wanted := diskRequests(v.Disks, r)
+	for i, d := range wanted {
+		address := fmt.Sprintf("%s.%d", d.DiskAddress.DeviceBus, d.DiskAddress.DeviceIndex)
+		ld, err := findDisk(*live, address)
+		if err != nil {
+			add("disks."+address, "", "attach")
+			continue
+		}
+		size := v.Disks[i].SizeGB << 30
+		switch {
+		case d.IsCdrom || size == 0 || size == ld.Size:
+		case size > ld.Size:
+			add("disks."+address+".size_gb", strconv.FormatInt(ld.Size>>30, 10), strconv.FormatInt(v.Disks[i].SizeGB, 10))
+		default:
+			ch.Notes = append(ch.Notes, fmt.Sprintf("disk %s can not shrink from %d GiB to %d GiB", address, ld.Size>>30, v.Disks[i].SizeGB))
+		}
+	}
+	for _, ld := range live.VMDiskInfo {
+		address := fmt.Sprintf("%s.%d", ld.DiskAddress.DeviceBus, ld.DiskAddress.DeviceIndex)
+		found := false
+		for _, d := range wanted {
+			if d.DiskAddress.DeviceBus == ld.DiskAddress.DeviceBus && d.DiskAddress.DeviceIndex == ld.DiskAddress.DeviceIndex {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		if o.Prune {
+			add("disks."+address, "attached", "detach")
+		} else {
+			ch.Notes = append(ch.Notes, "disk "+address+" is not in the manifest, use -prune to detach it")
+		}
+	}
+
+	return ch
+}
+
+// applyVMCreate creates the VM with the resources known after the networks
+// and images are applied
+func (c *client) applyVMCreate(s vmSpec, o planOptions) func() (string, error) {
+	return func() (string, error) {
+		r, err := c.loadResources()
+		if err != nil {
+			return "", err
+		}
+		if err := joinErrors(s.validate(r, nil)); err != nil {
+			return "", err
+		}
+		uuid, err := c.createVM(s.request(r), o.Timeout)
+		if err != nil {
+			return "", err
+		}
+		if s.PowerOn {
+			if err := c.powerVM(vm{UUID: uuid, Name: s.Name}, powerOptions{State: "on", API: "v2", Timeout: o.Timeout}); err != nil {
+				return "", err
+			}
+		}
+		return "created " + uuid, nil
+	}
+}
+
+// applyVMUpdate changes the live VM to match the spec
+func (c *client) applyVMUpdate(s vmSpec, live vm, o planOptions) func() (string, error) {
+	return func() (string, error) {
+		r, err := c.loadResources()
+		if err != nil {
+			return "", err
+		}
+		if err := joinErrors(s.validate(r, nil)); err != nil {
+			return "", err
+		}
+
+		ro := resizeOptions{Vcpus: s.Vcpus, Cores: s.CoresPerVcpu, MemoryMB: s.MemoryMB,
+			PowerCycle: o.AllowPowerCycle, ForceAfter: 2 * time.Minute, Timeout: o.Timeout}
+		if ro.Cores == 0 {
+			ro.Cores = 1
+		}
+		if err := c.resizeVM(live, ro); err != nil {
+			return "", err
+		}
+
+		if s.Description != live.Description {
+			req := map[string]string{"name": live.Name, "description": s.Description}
+			if err := c.updateVM(live.UUID, req, o.Timeout); err != nil {
+				return "", err
+			}
+		}
+
+		// NICs are matched by position
+		reqs := nicRequests(s.Nics, r)
+		for i := len(live.VMNics) - 1; i >= len(reqs); i-- {
+			if err := c.nicTask("DELETE", live, live.VMNics[i].MacAddress, nil, o.Timeout); err != nil {
+				return "", err
+			}
+		}
+		for i, req := range reqs {
+			if i >= len(live.VMNics) {
+				err = c.nicTask("POST", live, "", map[string]interface{}{"spec_list": []vmNicRequest{req}}, o.Timeout)
+			} else if ln := live.VMNics[i]; ln.NetworkUUID != req.NetworkUUID || req.RequestedIPAddress != "" && ln.RequestedIPAddress != req.RequestedIPAddress {
+				err = c.nicTask("PUT", live, ln.MacAddress, map[string]interface{}{"nic_spec": req}, o.Timeout)
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		// disks are matched by address, only new disks, larger disks and
+		// with -prune removed disks are applied
+		wanted := diskRequests(s.Disks, r)
+		for i, d := range wanted {
+			address := fmt.Sprintf("%s.%d", d.DiskAddress.DeviceBus, d.DiskAddress.DeviceIndex)
+			ld, err := findDisk(live, address)
+			if err != nil {
+				if err := c.diskTask("POST", live, "attach", []vmDiskRequest{d}, o.Timeout); err != nil {
+					return "", err
+				}
+				continue
+			}
+			size := s.Disks[i].SizeGB << 30
+			if !d.IsCdrom && size > ld.Size {
+				addr := ld.DiskAddress
+				req := vmDiskRequest{
+					DiskAddress:  &diskAddress{DeviceBus: addr.DeviceBus, DeviceIndex: addr.DeviceIndex, VMDiskUUID: addr.VMDiskUUID},
+					VMDiskCreate: &vmDiskCreate{StorageContainerUUID: ld.StorageContainerUUID, Size: size},
+				}
+				if err := c.diskTask("PUT", live, "update", []vmDiskRequest{req}, o.Timeout); err != nil {
+					return "", err
+				}
+			}
+		}
+		if o.Prune {
+			for _, ld := range live.VMDiskInfo {
+				found := false
+				for _, d := range wanted {
+					if d.DiskAddress.DeviceBus == ld.DiskAddress.DeviceBus && d.DiskAddress.DeviceIndex == ld.DiskAddress.DeviceIndex {
+						found = true
+					}
+				}
+				if found {
+					continue
+				}
+				addr := ld.DiskAddress
+				req := vmDiskRequest{IsCdrom: ld.IsCdrom, DiskAddress: &diskAddress{
+					DeviceBus: addr.DeviceBus, DeviceIndex: addr.DeviceIndex, VMDiskUUID: addr.VMDiskUUID}}
+				if err := c.diskTask("POST", live, "detach", []vmDiskRequest{req}, o.Timeout); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		return "updated", nil
+	}
+}
+
+// loadPlan reads the manifests and computes the plan
+func (c *client) loadPlan(o planOptions) (*plan, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	m, err := readManifests(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.networks)+len(m.images)+len(m.vms) == 0 {
+		return nil, errors.New("no manifests found in " + o.Dir)
+	}
+	return c.makePlan(m, o)
+}
+
+// runPlan is the "plan" command
+func runPlan(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	var o planOptions
+	o.addFlags(fs)
+	fs.Parse(args)
+
+	p, err := c.loadPlan(o)
+	if err != nil {
+		return err
+	}
+	p.print()
+	return nil
+}
+
+// runApply is the "apply" command
+func runApply(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	var o planOptions
+	o.addFlags(fs)
+	var yes = fs.Bool("yes", false, "apply without confirmation")
+	fs.Parse(args)
+
+	p, err := c.loadPlan(o)
+	if err != nil {
+		return err
+	}
+	p.print()
+	if len(p.changes) == 0 {
+		return nil
+	}
+
+	if !*yes && !confirm("Apply the plan?") {
+		return errors.New("aborted")
+	}
+
+	// later changes may depend on earlier ones, so apply stops at the first error
+	for i, ch := range p.changes {
+		start := time.Now()
+		msg, err := ch.apply()
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %v (%d of %d changes applied)", ch.Action, strings.ToLower(ch.Kind), ch.Name, err, i, len(p.changes))
+		}
+		fmt.Printf("%s %s: %s (%s)\n", strings.ToLower(ch.Kind), ch.Name, msg, time.Since(start).Round(time.Second))
+	}
+
+	fmt.Printf("Apply complete, %d changes applied.\n", len(p.changes))
+	return nil
+}
+
+func init() {
+	register(command{name: "plan", usage: "show the changes to reach the state of a manifest directory", run: runPlan})
+	register(command{name: "apply", usage: "apply the changes to reach the state of a manifest directory", run: runApply})
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestYAMLManifest(t *testing.T) {
+
+	js, err := yamlManifest([]byte("kind: VM\nname: 2019\ndescription: 1.10\nvcpus: 2\npower_on: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"description":"1.10","kind":"VM","name":"2019","power_on":true,"vcpus":2}`
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+
+	docs := splitDocuments([]byte("a: 1\n---\n# only a comment\n---\nb: 2\n"))
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents, want 2", len(docs))
+	}
+}
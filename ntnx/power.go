@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// powerTransition maps a power operation to the v2 transition and the power
+// state the VM has to reach
+type powerTransition struct {
+	Transition string
+	State      string
+}
+
+// powerTransitions are all power operations of "vm power -state"
+var powerTransitions = map[string]powerTransition{
+	"on":         {"ON", "on"},
+	"off":        {"OFF", "off"},
+	"shutdown":   {"ACPI_SHUTDOWN", "off"},
+	"reboot":     {"ACPI_REBOOT", "on"},
+	"reset":      {"RESET", "on"},
+	"powercycle": {"POWERCYCLE", "on"},
+	"suspend":    {"SUSPEND", "suspended"},
+	"resume":     {"RESUME", "on"},
+	"pause":      {"PAUSE", "paused"},
+}
+
+// powerOptions are the options of a power operation
+type powerOptions struct {
+	State      string
+	API        string
+	Timeout    time.Duration
+	ForceAfter time.Duration
+}
+
+// addFlags registers the power flags on fs
+func (o *powerOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.State, "state", "", "on, off, shutdown (ACPI), reboot (ACPI), reset, powercycle, suspend, resume or pause")
+	fs.StringVar(&o.API, "api", "v2", "API used for the transition: v2 or v3 (v3 supports on, off and shutdown)")
+	fs.DurationVar(&o.Timeout, "timeout", 5*time.Minute, "time to wait for the VM to reach the power state")
+	fs.DurationVar(&o.ForceAfter, "force-after", 0, "power off the VM if a shutdown did not finish in this time (0 disables)")
+}
+
+// validate checks the state and API of the options
+func (o powerOptions) validate() error {
+	if _, ok := powerTransitions[o.State]; !ok {
+		return fmt.Errorf("unknown power state %q", o.State)
+	}
+	switch o.API {
+	case "v2":
+	case "v3":
+		if o.State != "on" && o.State != "off" && o.State != "shutdown" {
+			return fmt.Errorf("power state %q is not supported by the v3 API", o.State)
+		}
+	default:
+		return fmt.Errorf("unknown API %q", o.API)
+	}
+	if o.ForceAfter > 0 && o.State != "shutdown" {
+		return errors.New("-force-after can only be used with -state shutdown")
+	}
+	if o.ForceAfter > 0 && o.ForceAfter >= o.Timeout {
+		return errors.New("-force-after has to be shorter than -timeout")
+	}
+	return nil
+}
+
+// setPowerStateV2 sends the transition with the v2 API and waits for the task
+func (c *client) setPowerStateV2(uuid string, transition string, timeout time.Duration) error {
+	var resp taskResponse
+	body := map[string]string{"transition": transition}
+	if err := c.post(c.v2("/vms/"+uuid+"/set_power_state"), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// setPowerStateV3 updates the power state in the v3 VM spec and waits for the
+// task. A shutdown is send as OFF with the ACPI mechanism.
+func (c *client) setPowerStateV3(uuid string, state string, timeout time.Duration) error {
+
+	// the v3 API replaces the whole spec, so the current spec is read first
+	var v map[string]interface{}
+	if err := c.get(c.v3("/vms/"+uuid), &v); err != nil {
+		return err
+	}
+	delete(v, "status")
+
+	spec, _ := v["spec"].(map[string]interface{})
+	resources, _ := spec["resources"].(map[string]interface{})
+	if resources == nil {
+		return errors.New("v3 VM " + uuid + " has no spec resources")
+	}
+
+	switch state {
+	case "on":
+		resources["power_state"] = "ON"
+	case "off":
+		resources["power_state"] = "OFF"
+		resources["power_state_mechanism"] = map[string]string{"mechanism": "HARD"}
+	case "shutdown":
+		resources["power_state"] = "OFF"
+		resources["power_state_mechanism"] = map[string]string{"mechanism": "ACPI"}
+	}
+
+	var resp struct {
+		Status struct {
+			ExecutionContext struct {
+				TaskUUID string `json:"task_uuid"`
+			} `json:"execution_context"`
+		} `json:"status"`
+	}
+	if err := c.put(c.v3("/vms/"+uuid), v, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTaskV3(resp.Status.ExecutionContext.TaskUUID, timeout)
+	return err
+}
+
+// waitPowerState polls the VM until it reached the power state. The task of a
+// transition may finish before the power state is updated.
+func (c *client) waitPowerState(uuid string, state string, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		v, err := c.getVM(uuid)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(v.PowerState, state) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("VM %s is %s instead of %s after %s", v.Name, v.PowerState, state, timeout)
+		}
+		time.Sleep(taskPollInterval)
+	}
+}
+
+// setPowerState sends the power state with the v2 or v3 API and waits for the
+// task
+func (c *client) setPowerState(uuid string, api string, state string, timeout time.Duration) error {
+	if api == "v3" {
+		return c.setPowerStateV3(uuid, state, timeout)
+	}
+	return c.setPowerStateV2(uuid, powerTransitions[state].Transition, timeout)
+}
+
+// restarts are the power operations which end in the power state the VM had
+var restarts = map[string]bool{"reboot": true, "reset": true, "powercycle": true}
+
+// restartVM reboots, resets or power cycles a running VM. The VM is on before
+// and after and Prism has no boot time of the guest, so the restart is only
+// verified if the VM leaves "on" while it is polled during and after the
+// task. A restart which is too fast to be seen is reported as confirmed by
+// the task only.
+func (c *client) restartVM(v vm, o powerOptions) error {
+
+	deadline := time.Now().Add(o.Timeout)
+
+	before, err := c.getVM(v.UUID)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(before.PowerState, "on") {
+		return fmt.Errorf("VM %s is %s, %s needs a running VM", before.Name, before.PowerState, o.State)
+	}
+
+	var resp taskResponse
+	body := map[string]string{"transition": powerTransitions[o.State].Transition}
+	if err := c.post(c.v2("/vms/"+v.UUID+"/set_power_state"), body, &resp); err != nil {
+		return err
+	}
+	task := make(chan error, 1)
+	go func() {
+		_, err := c.waitTask(resp.TaskUUID, o.Timeout)
+		task <- err
+	}()
+
+	left, done := false, false
+	for {
+		if !done {
+			select {
+			case err := <-task:
+				if err != nil {
+					return err
+				}
+				done = true
+			default:
+			}
+		}
+		after, err := c.getVM(v.UUID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !strings.EqualFold(after.PowerState, "on"):
+			left = true
+		case done && left:
+			return nil
+		case done:
+			fmt.Fprintf(os.Stderr, "%s: %s task completed, the restart was not observed\n", before.Name, o.State)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("VM %s did not %s within %s", before.Name, o.State, o.Timeout)
+		}
+		time.Sleep(taskPollInterval)
+	}
+}
+
+// powerVM changes the power state of the VM and verifies the VM reached it
+func (c *client) powerVM(v vm, o powerOptions) error {
+
+	if restarts[o.State] {
+		return c.restartVM(v, o)
+	}
+
+	pt := powerTransitions[o.State]
+	deadline := time.Now().Add(o.Timeout)
+
+	if o.ForceAfter <= 0 {
+		if err := c.setPowerState(v.UUID, o.API, o.State, o.Timeout); err != nil {
+			return err
+		}
+		return c.waitPowerState(v.UUID, pt.State, time.Until(deadline))
+	}
+
+	// a guest may ignore the ACPI shutdown, the task then fails or does not
+	// finish. The VM is powered off if it did not shutdown within ForceAfter.
+	force := time.Now().Add(o.ForceAfter)
+	err := c.setPowerState(v.UUID, o.API, o.State, o.ForceAfter)
+	if err != nil && !errors.Is(err, errTaskTimeout) && !errors.Is(err, errTaskFailed) {
+		return err
+	}
+	if err == nil {
+		if err = c.waitPowerState(v.UUID, pt.State, time.Until(force)); err == nil {
+			return nil
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: no shutdown after %s (%v), powering off\n", v.Name, o.ForceAfter, err)
+
+	if err := c.setPowerState(v.UUID, o.API, "off", time.Until(deadline)); err != nil {
+		return err
+	}
+	return c.waitPowerState(v.UUID, pt.State, time.Until(deadline))
+}
+
+// runVMPower is the "vm power" command
+func runVMPower(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm power", flag.ExitOnError)
+	var s vmSelector
+	var o powerOptions
+	s.addFlags(fs)
+	o.addFlags(fs)
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+
+	return forEachVM(vms, func(v vm) (string, error) {
+		return powerTransitions[o.State].State, c.powerVM(v, o)
+	})
+}
+
+func init() {
+	register(command{name: "vm power", usage: "change the power state of VMs and wait for it", run: runVMPower})
+}
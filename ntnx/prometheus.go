@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promName returns the Prometheus metric name of the sample like
+// "nutanix_cluster_storage_usage_bytes"
+func promName(s metricSample) string {
+	name := []byte("nutanix_" + s.Kind + "_" + s.Name)
+	for i, b := range name {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// promLabels returns the labels in the exposition format sorted by name
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+`="`+escape.Replace(labels[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// renderPrometheus renders the scrapes in the Prometheus text exposition
+// format with the samples grouped by metric name. Peer hosts of the same
+// cluster report the same entities, a series is only rendered for the first
+// host reporting it. The labels of all samples contain the cluster UUID.
+func renderPrometheus(scrapes []metricScrape) []byte {
+
+	type series struct {
+		help  string
+		lines []string
+	}
+	metrics := make(map[string]*series)
+	seen := make(map[string]bool)
+	add := func(name string, help string, labels map[string]string, value float64) {
+		key := name + promLabels(labels)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		m, ok := metrics[name]
+		if !ok {
+			m = &series{help: help}
+			metrics[name] = m
+		}
+		m.lines = append(m.lines, key+" "+strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	for _, s := range scrapes {
+		up := 1.0
+		if s.Err != nil {
+			up = 0
+		}
+		prism := map[string]string{"prism": s.Host}
+		add("nutanix_up", "Whether the last scrape of the Prism host succeeded.", prism, up)
+		add("nutanix_scrape_duration_seconds", "Duration of the last scrape of the Prism host.", prism, s.Duration.Seconds())
+		for _, sample := range s.Samples {
+			add(promName(sample), fmt.Sprintf("Prism %s stat %s.", sample.Kind, sample.Name), sample.Labels, sample.Value)
+		}
+	}
+
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		m := metrics[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		for _, line := range m.lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// exporter serves the metrics. Prism is scraped at most once per cache
+// period, scrapes within the period are served from the cache.
+type exporter struct {
+	c     *client
+	cache time.Duration
+
+	mu      sync.Mutex
+	scraped time.Time
+	body    []byte
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	if e.body == nil || time.Since(e.scraped) >= e.cache {
+		scrapes := e.c.scrapeMetrics()
+		for _, s := range scrapes {
+			if s.Err != nil {
+				log.Printf("scrape %s: %v", s.Host, s.Err)
+			}
+		}
+		e.body = renderPrometheus(scrapes)
+		e.scraped = time.Now()
+	}
+	body := e.body
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(body)
+}
+
+// runExporter is the "exporter" command
+func runExporter(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	var listen = fs.String("listen", ":9405", "address to serve /metrics on")
+	var cache = fs.Duration("cache", time.Minute, "serve the metrics from the cache for this period before Prism is scraped again")
+	fs.Parse(args)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &exporter{c: c, cache: *cache})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `<html><body><a href="/metrics">Metrics</a></body></html>`)
+	})
+
+	log.Printf("serving metrics of %d Prism hosts on %s/metrics", len(c.all()), *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+func init() {
+	register(command{name: "exporter", usage: "serve cluster, host, VM and container stats for Prometheus", run: runExporter})
+}
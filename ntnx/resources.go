@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// image is an image of the image service as returned by the v2 /images API
+type image struct {
+	UUID                 string `json:"uuid"`
+	Name                 string `json:"name"`
+	Annotation           string `json:"annotation"`
+	ImageType            string `json:"image_type"`
+	VMDiskID             string `json:"vm_disk_id"`
+	VMDiskSize           int64  `json:"vm_disk_size"`
+	StorageContainerUUID string `json:"storage_container_uuid"`
+	ImageState           string `json:"image_state"`
+}
+
+// storageContainer is a container as returned by the v2 /storage_containers API
+type storageContainer struct {
+	UUID              string `json:"storage_container_uuid"`
+	Name              string `json:"name"`
+	ReplicationFactor int    `json:"replication_factor"`
+	MaxCapacity       int64  `json:"max_capacity"`
+	ClusterUUID       string `json:"cluster_uuid"`
+
+	// UsageStats are the storage usage stats like the cluster usage stats,
+	// all values are send as strings
+	UsageStats map[string]string `json:"usage_stats"`
+}
+
+// network is a network as returned by the v2 /networks API
+type network struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	VlanID   int    `json:"vlan_id"`
+	IPConfig struct {
+		NetworkAddress string `json:"network_address"`
+		PrefixLength   int    `json:"prefix_length"`
+		DefaultGateway string `json:"default_gateway"`
+	} `json:"ip_config"`
+}
+
+// host is a host as returned by the v2 /hosts API
+type host struct {
+	UUID              string `json:"uuid"`
+	Name              string `json:"name"`
+	HypervisorAddress string `json:"hypervisor_address"`
+	HypervisorType    string `json:"hypervisor_type"`
+	State             string `json:"state"`
+	ClusterUUID       string `json:"cluster_uuid"`
+	Serial            string `json:"serial"`
+	BlockSerial       string `json:"block_serial"`
+	BlockModelName    string `json:"block_model_name"`
+	CVMAddress        string `json:"service_vmexternal_ip"`
+	IPMIAddress       string `json:"ipmi_address"`
+	Position          struct {
+		Ordinal int    `json:"ordinal"`
+		Name    string `json:"name"`
+	} `json:"position"`
+
+	// Stats and UsageStats are the performance and storage stats, all values
+	// are send as strings
+	Stats      map[string]string `json:"stats"`
+	UsageStats map[string]string `json:"usage_stats"`
+}
+
+// listImages returns all images of the image service
+func (c *client) listImages() ([]image, error) {
+	var resp struct {
+		Entities []image `json:"entities"`
+	}
+	err := c.get(c.v2("/images/"), &resp)
+	return resp.Entities, err
+}
+
+// listStorageContainers returns all storage containers
+func (c *client) listStorageContainers() ([]storageContainer, error) {
+	var resp struct {
+		Entities []storageContainer `json:"entities"`
+	}
+	err := c.get(c.v2("/storage_containers/"), &resp)
+	return resp.Entities, err
+}
+
+// listNetworks returns all networks
+func (c *client) listNetworks() ([]network, error) {
+	var resp struct {
+		Entities []network `json:"entities"`
+	}
+	err := c.get(c.v2("/networks/"), &resp)
+	return resp.Entities, err
+}
+
+// listHosts returns all hosts
+func (c *client) listHosts() ([]host, error) {
+	var resp struct {
+		Entities []host `json:"entities"`
+	}
+	err := c.get(c.v2("/hosts/"), &resp)
+	return resp.Entities, err
+}
+
+// errNotFound is wrapped by the errors of the resources which have no entity
+// with the name
+var errNotFound = errors.New("not found")
+
+// resources holds the images, containers and networks of a cluster to
+// resolve the names used in spec files
+type resources struct {
+	images     []image
+	containers []storageContainer
+	networks   []network
+}
+
+// loadResources receives all images, containers and networks of the cluster
+func (c *client) loadResources() (*resources, error) {
+	var r resources
+	var err error
+	if r.images, err = c.listImages(); err != nil {
+		return nil, err
+	}
+	if r.containers, err = c.listStorageContainers(); err != nil {
+		return nil, err
+	}
+	if r.networks, err = c.listNetworks(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// image returns the image with the name, names have to be unique
+func (r *resources) image(name string) (*image, error) {
+	var found []*image
+	for i := range r.images {
+		if r.images[i].Name == name {
+			found = append(found, &r.images[i])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("image %q %w", name, errNotFound)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("image name %q is not unique", name)
+}
+
+// container returns the storage container with the name
+func (r *resources) container(name string) (*storageContainer, error) {
+	for i := range r.containers {
+		if r.containers[i].Name == name {
+			return &r.containers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("storage container %q %w", name, errNotFound)
+}
+
+// network returns the network with the name, names have to be unique
+func (r *resources) network(name string) (*network, error) {
+	var found []*network
+	for i := range r.networks {
+		if r.networks[i].Name == name {
+			found = append(found, &r.networks[i])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("network %q %w", name, errNotFound)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("network name %q is not unique", name)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// reductionTechniques are the data reduction techniques in the usage stats.
+// The empty name is the overall data reduction.
+var reductionTechniques = []string{"compression", "dedup", "erasure_coding", ""}
+
+// reduction are the savings of a data reduction technique
+type reduction struct {
+	Technique  string  `json:"technique"`
+	PreBytes   int64   `json:"pre_reduction_bytes"`
+	PostBytes  int64   `json:"post_reduction_bytes"`
+	SavedBytes int64   `json:"saved_bytes"`
+	Ratio      float64 `json:"ratio"`
+}
+
+// savingsReport are the data reduction savings of a cluster or container
+type savingsReport struct {
+	Cluster    string      `json:"cluster"`
+	Container  string      `json:"container,omitempty"`
+	Reductions []reduction `json:"reductions"`
+}
+
+// dataReduction computes the savings from the data_reduction.* usage stats.
+// Saved bytes and ratio are computed from the pre and post reduction bytes if
+// the API does not send them.
+func dataReduction(stats map[string]string) []reduction {
+	var out []reduction
+	for _, t := range reductionTechniques {
+		prefix := "data_reduction."
+		name := "overall"
+		if t != "" {
+			prefix += t + "."
+			name = t
+		}
+		r := reduction{
+			Technique:  name,
+			PreBytes:   nonNegative(statValue(stats[prefix+"pre_reduction_bytes"])),
+			PostBytes:  nonNegative(statValue(stats[prefix+"post_reduction_bytes"])),
+			SavedBytes: statValue(stats[prefix+"saved_bytes"]),
+		}
+		if r.SavedBytes < 0 {
+			r.SavedBytes = nonNegative(r.PreBytes - r.PostBytes)
+		}
+		if ppm := statValue(stats[prefix+"saving_ratio_ppm"]); ppm > 0 {
+			r.Ratio = float64(ppm) / 1e6
+		} else if r.PostBytes > 0 {
+			r.Ratio = float64(r.PreBytes) / float64(r.PostBytes)
+		} else {
+			r.Ratio = 1
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// savingsReports returns the reports of all clusters and optionally their
+// containers. A cluster reached through several peers is reported once.
+func (c *client) savingsReports(containers bool) ([]savingsReport, error) {
+	reports := []savingsReport{}
+	seen := make(map[string]bool)
+	seenContainers := make(map[string]bool)
+	for _, cc := range c.all() {
+		clusters, err := cc.listClusters()
+		if err != nil {
+			return nil, err
+		}
+		for _, ci := range clusters {
+			if seen[ci.UUID] {
+				continue
+			}
+			seen[ci.UUID] = true
+			reports = append(reports, savingsReport{Cluster: ci.Name, Reductions: dataReduction(ci.UsageStats.values())})
+		}
+		if !containers || len(clusters) == 0 {
+			continue
+		}
+
+		// a Prism Element may not send the cluster UUID, its containers
+		// belong to its single cluster then
+		names := make(map[string]string)
+		for _, ci := range clusters {
+			names[ci.UUID] = ci.Name
+		}
+		scs, err := cc.listStorageContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, sc := range scs {
+			if seenContainers[sc.UUID] {
+				continue
+			}
+			seenContainers[sc.UUID] = true
+			cluster, ok := names[sc.ClusterUUID]
+			switch {
+			case !ok && sc.ClusterUUID == "" && len(clusters) == 1:
+				cluster = clusters[0].Name
+			case !ok:
+				cluster = orNone(sc.ClusterUUID)
+			}
+			reports = append(reports, savingsReport{Cluster: cluster, Container: sc.Name, Reductions: dataReduction(sc.UsageStats)})
+		}
+	}
+	return reports, nil
+}
+
+// printSavingsSummary prints a table with a row per cluster or container and
+// the saved bytes and ratio of every technique
+func printSavingsSummary(reports []savingsReport) {
+	fmt.Printf("%-16s %-16s", "CLUSTER", "CONTAINER")
+	for _, t := range reductionTechniques {
+		if t == "" {
+			t = "overall"
+		}
+		fmt.Printf(" %22s", t)
+	}
+	fmt.Println()
+	for _, r := range reports {
+		fmt.Printf("%-16s %-16s", r.Cluster, orNone(r.Container))
+		for _, red := range r.Reductions {
+			fmt.Printf(" %22s", fmt.Sprintf("%s (%.2f:1)", formatBytes(red.SavedBytes), red.Ratio))
+		}
+		fmt.Println()
+	}
+}
+
+// writeSavingsCSV writes a row per cluster, container and technique
+func writeSavingsCSV(w io.Writer, reports []savingsReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"cluster", "container", "technique", "pre_reduction_bytes", "post_reduction_bytes", "saved_bytes", "ratio"})
+	for _, r := range reports {
+		for _, red := range r.Reductions {
+			cw.Write([]string{r.Cluster, r.Container, red.Technique,
+				strconv.FormatInt(red.PreBytes, 10), strconv.FormatInt(red.PostBytes, 10), strconv.FormatInt(red.SavedBytes, 10),
+				strconv.FormatFloat(red.Ratio, 'f', 3, 64)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runClusterSavings is the "cluster savings" command
+func runClusterSavings(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster savings", flag.ExitOnError)
+	var containers = fs.Bool("containers", false, "include the storage containers of the clusters")
+	var csvFile = fs.String("csv", "", "write the report as CSV to file, - for stdout")
+	var jsonOut = fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	reports, err := c.savingsReports(*containers)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *csvFile == "-":
+		return writeSavingsCSV(os.Stdout, reports)
+	case *jsonOut:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	default:
+		printSavingsSummary(reports)
+	}
+
+	if *csvFile != "" && *csvFile != "-" {
+		f, err := os.Create(*csvFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeSavingsCSV(f, reports)
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "cluster savings", usage: "report the compression, dedup and erasure coding savings", run: runClusterSavings})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// hardeningPolicy are the expected security compliance settings of the CVMs
+// or the hypervisors. Settings which are not set are not checked.
+type hardeningPolicy struct {
+	Aide                 *bool   `json:"aide"`
+	Core                 *bool   `json:"core"`
+	HighStrengthPassword *bool   `json:"high_strength_password"`
+	Banner               *bool   `json:"banner"`
+	SNMPv3Only           *bool   `json:"snmpv3_only"`
+	Schedule             *string `json:"schedule"`
+}
+
+// securityPolicy is the policy the clusters are scored against
+//
+//	cvm:
+//	  aide: true
+//	  core: false
+//	  high_strength_password: true
+//	  banner: true
+//	  snmpv3_only: true
+//	  schedule: DAILY
+//	hypervisor:
+//	  aide: true
+//	  high_strength_password: true
+//	password_remote_login: false
+//	self_encrypting_drive: true
+type securityPolicy struct {
+	CVM                 hardeningPolicy `json:"cvm"`
+	Hypervisor          hardeningPolicy `json:"hypervisor"`
+	PasswordRemoteLogin *bool           `json:"password_remote_login"`
+	SelfEncryptingDrive *bool           `json:"self_encrypting_drive"`
+}
+
+// defaultSecurityPolicy is used if no policy file is given. It follows the
+// Nutanix security hardening guide.
+func defaultSecurityPolicy() securityPolicy {
+	yes, no := true, false
+	return securityPolicy{
+		CVM:                 hardeningPolicy{Aide: &yes, Core: &no, HighStrengthPassword: &yes, Banner: &yes, SNMPv3Only: &yes},
+		Hypervisor:          hardeningPolicy{Aide: &yes, Core: &no, HighStrengthPassword: &yes, Banner: &yes},
+		PasswordRemoteLogin: &no,
+	}
+}
+
+// securityCheck is the result of a single setting
+type securityCheck struct {
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Passed   bool   `json:"passed"`
+}
+
+// securityReport is the result of a cluster
+type securityReport struct {
+	Cluster string          `json:"cluster"`
+	Score   int             `json:"score"`
+	Passed  int             `json:"passed"`
+	Failed  int             `json:"failed"`
+	Checks  []securityCheck `json:"checks"`
+}
+
+// boolCheck appends the check name if the policy value p is set
+func boolCheck(checks []securityCheck, name string, p *bool, actual bool) []securityCheck {
+	if p == nil {
+		return checks
+	}
+	return append(checks, securityCheck{Name: name, Expected: fmt.Sprint(*p), Actual: fmt.Sprint(actual), Passed: *p == actual})
+}
+
+// check scores the cluster against the policy. The score is the percentage
+// of passed checks.
+func (p securityPolicy) check(ci clusterInfo) securityReport {
+
+	var checks []securityCheck
+
+	cvm := ci.SecurityComplianceConfig
+	checks = boolCheck(checks, "cvm.aide", p.CVM.Aide, cvm.EnableAide)
+	checks = boolCheck(checks, "cvm.core", p.CVM.Core, cvm.EnableCore)
+	checks = boolCheck(checks, "cvm.high_strength_password", p.CVM.HighStrengthPassword, cvm.EnableHighStrengthPassword)
+	checks = boolCheck(checks, "cvm.banner", p.CVM.Banner, cvm.EnableBanner)
+	checks = boolCheck(checks, "cvm.snmpv3_only", p.CVM.SNMPv3Only, cvm.EnableSNMPv3Only)
+	if p.CVM.Schedule != nil {
+		checks = append(checks, securityCheck{Name: "cvm.schedule", Expected: *p.CVM.Schedule, Actual: cvm.Schedule,
+			Passed: strings.EqualFold(*p.CVM.Schedule, cvm.Schedule)})
+	}
+
+	hv := ci.HypervisorSecurityComplianceConfig
+	checks = boolCheck(checks, "hypervisor.aide", p.Hypervisor.Aide, hv.EnableAide)
+	checks = boolCheck(checks, "hypervisor.core", p.Hypervisor.Core, hv.EnableCore)
+	checks = boolCheck(checks, "hypervisor.high_strength_password", p.Hypervisor.HighStrengthPassword, hv.EnableHighStrengthPassword)
+	checks = boolCheck(checks, "hypervisor.banner", p.Hypervisor.Banner, hv.EnableBanner)
+	if p.Hypervisor.Schedule != nil {
+		checks = append(checks, securityCheck{Name: "hypervisor.schedule", Expected: *p.Hypervisor.Schedule, Actual: hv.Schedule,
+			Passed: strings.EqualFold(*p.Hypervisor.Schedule, hv.Schedule)})
+	}
+
+	checks = boolCheck(checks, "password_remote_login", p.PasswordRemoteLogin, ci.EnablePasswordRemoteLoginToCluster)
+	checks = boolCheck(checks, "self_encrypting_drive", p.SelfEncryptingDrive, ci.HasSelfEncryptingDrive)
+
+	r := securityReport{Cluster: ci.Name, Score: 100, Checks: checks}
+	for _, c := range checks {
+		if c.Passed {
+			r.Passed++
+		} else {
+			r.Failed++
+		}
+	}
+	if len(checks) > 0 {
+		r.Score = r.Passed * 100 / len(checks)
+	}
+	return r
+}
+
+// printSecurityText prints the reports as plain text
+func printSecurityText(reports []securityReport) {
+	for _, r := range reports {
+		fmt.Printf("%s: score %d%% (%d passed, %d failed)\n", r.Cluster, r.Score, r.Passed, r.Failed)
+		for _, c := range r.Checks {
+			result := "PASS"
+			if !c.Passed {
+				result = "FAIL"
+			}
+			fmt.Printf("  %-4s %-36s expected %-6s actual %s\n", result, c.Name, c.Expected, c.Actual)
+		}
+	}
+}
+
+// printSecurityMarkdown prints the reports as Markdown with a summary table
+// and a table per cluster
+func printSecurityMarkdown(reports []securityReport) {
+	fmt.Println("# Security compliance report")
+	fmt.Println()
+	fmt.Println("| Cluster | Score | Passed | Failed |")
+	fmt.Println("|---|---:|---:|---:|")
+	for _, r := range reports {
+		fmt.Printf("| %s | %d%% | %d | %d |\n", r.Cluster, r.Score, r.Passed, r.Failed)
+	}
+	for _, r := range reports {
+		fmt.Println()
+		fmt.Printf("## %s\n", r.Cluster)
+		fmt.Println()
+		fmt.Println("| Check | Expected | Actual | Result |")
+		fmt.Println("|---|---|---|---|")
+		for _, c := range r.Checks {
+			result := "pass"
+			if !c.Passed {
+				result = "**fail**"
+			}
+			fmt.Printf("| %s | %s | %s | %s |\n", c.Name, c.Expected, c.Actual, result)
+		}
+	}
+}
+
+// junitTestSuites is the JUnit XML format most CI systems understand. Every
+// cluster is a test suite and every check a test case.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// printSecurityJUnit prints the reports as JUnit XML
+func printSecurityJUnit(reports []securityReport) error {
+	out := junitTestSuites{Name: "security compliance"}
+	for _, r := range reports {
+		suite := junitTestSuite{Name: r.Cluster, Tests: len(r.Checks), Failures: r.Failed}
+		for _, c := range r.Checks {
+			tc := junitTestCase{Name: c.Name, Classname: "security." + r.Cluster}
+			if !c.Passed {
+				tc.Failure = &junitFailure{Message: fmt.Sprintf("expected %s, actual %s", c.Expected, c.Actual)}
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		out.Tests += suite.Tests
+		out.Failures += suite.Failures
+		out.Suites = append(out.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Print(xml.Header)
+	fmt.Println(string(data))
+	return nil
+}
+
+// runClusterSecurity is the "cluster security" command
+func runClusterSecurity(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster security", flag.ExitOnError)
+	var file = fs.String("policy", "", "policy file (YAML or JSON), the hardening guide defaults are used if not set")
+	var format = fs.String("format", "text", "output format: text, json, markdown or junit")
+	var minScore = fs.Int("min-score", 0, "fail if the score of a cluster is below min-score percent")
+	fs.Parse(args)
+
+	switch *format {
+	case "text", "json", "markdown", "junit":
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	policy := defaultSecurityPolicy()
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		policy = securityPolicy{}
+		if err := decodeSpec(*file, data, &policy); err != nil {
+			return err
+		}
+	}
+
+	clusters, err := c.listAllClusters()
+	if err != nil {
+		return err
+	}
+
+	reports := []securityReport{}
+	var below []string
+	for _, ci := range clusters {
+		r := policy.check(ci)
+		if r.Score < *minScore {
+			below = append(below, fmt.Sprintf("%s (%d%%)", r.Cluster, r.Score))
+		}
+		reports = append(reports, r)
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	case "markdown":
+		printSecurityMarkdown(reports)
+	case "junit":
+		if err := printSecurityJUnit(reports); err != nil {
+			return err
+		}
+	default:
+		printSecurityText(reports)
+	}
+
+	if len(below) > 0 {
+		return fmt.Errorf("score below %d%%: %s", *minScore, strings.Join(below, ", "))
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "cluster security", usage: "score the security hardening of the clusters against a policy", run: runClusterSecurity})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sinkOptions configure how the samples are written
+type sinkOptions struct {
+	Kinds        map[string]bool   // sample kinds to write
+	Measurements map[string]string // measurement name or Graphite prefix per kind
+	Tags         []string          // labels written as tags, all if empty
+	ExtraTags    map[string]string // static tags added to every line
+}
+
+// measurement returns the measurement name of kind, "nutanix_<kind>" if not
+// configured
+func (o sinkOptions) measurement(kind string) string {
+	if m, ok := o.Measurements[kind]; ok {
+		return m
+	}
+	return "nutanix_" + kind
+}
+
+// tags returns the labels and the extra tags selected by the options in
+// the order they are written
+func (o sinkOptions) tags(labels map[string]string) [][2]string {
+	var keys []string
+	if len(o.Tags) > 0 {
+		keys = o.Tags
+	} else {
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	}
+	var tags [][2]string
+	for _, k := range keys {
+		if v, ok := labels[k]; ok && v != "" {
+			tags = append(tags, [2]string{k, v})
+		}
+	}
+	var extra []string
+	for k := range o.ExtraTags {
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		tags = append(tags, [2]string{k, o.ExtraTags[k]})
+	}
+	return tags
+}
+
+// parseKeyValues parses "key=value,key=value"
+func parseKeyValues(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid key=value %q", kv)
+		}
+		m[kv[:i]] = kv[i+1:]
+	}
+	return m, nil
+}
+
+// sampleGroup are the samples of one entity, they are written as one
+// InfluxDB line
+type sampleGroup struct {
+	kind    string
+	labels  map[string]string
+	samples []metricSample
+}
+
+// groupSamples groups the samples by entity keeping their order
+func groupSamples(samples []metricSample) []*sampleGroup {
+	var groups []*sampleGroup
+	index := make(map[string]*sampleGroup)
+	for _, s := range samples {
+		key := s.Kind + promLabels(s.Labels)
+		g, ok := index[key]
+		if !ok {
+			g = &sampleGroup{kind: s.Kind, labels: s.Labels}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.samples = append(g.samples, s)
+	}
+	return groups
+}
+
+var (
+	influxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscape         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// formatInflux returns the samples in the InfluxDB line protocol, one line
+// per entity with a field per stat
+func formatInflux(samples []metricSample, o sinkOptions, t time.Time) []byte {
+	var buf bytes.Buffer
+	for _, g := range groupSamples(samples) {
+		buf.WriteString(influxMeasurementEscape.Replace(o.measurement(g.kind)))
+		for _, tag := range o.tags(g.labels) {
+			buf.WriteString("," + influxKeyEscape.Replace(tag[0]) + "=" + influxKeyEscape.Replace(tag[1]))
+		}
+		for i, s := range g.samples {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			buf.WriteString(sep + influxKeyEscape.Replace(s.Name) + "=" + strconv.FormatInt(int64(s.Value), 10) + "i")
+		}
+		fmt.Fprintf(&buf, " %d\n", t.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+// graphiteEscape replaces the characters Graphite uses as separators in a
+// path node
+var graphiteEscape = strings.NewReplacer(".", "_", " ", "_", "/", "_")
+
+// formatGraphite returns the samples in the Graphite plaintext protocol. The
+// path is the measurement, the tag values and the stat name like
+// "nutanix_vm.lab.node-a.web-01.hypervisor_cpu_usage_ppm".
+func formatGraphite(samples []metricSample, o sinkOptions, t time.Time) []byte {
+	var buf bytes.Buffer
+	for _, s := range samples {
+		path := []string{o.measurement(s.Kind)}
+		for _, tag := range o.tags(s.Labels) {
+			path = append(path, graphiteEscape.Replace(tag[1]))
+		}
+		path = append(path, strings.Replace(s.Name, " ", "_", -1))
+		fmt.Fprintf(&buf, "%s %s %d\n", strings.Join(path, "."), strconv.FormatFloat(s.Value, 'f', -1, 64), t.Unix())
+	}
+	return buf.Bytes()
+}
+
+// sinkWriter writes to stdout, a file or a TCP or UDP endpoint. TCP
+// connections are dialed again after an error.
+type sinkWriter struct {
+	target string
+	w      io.Writer
+	conn   net.Conn
+}
+
+// newSinkWriter opens target: "-" for stdout, tcp://host:port,
+// udp://host:port or a file the lines are appended to
+func newSinkWriter(target string) (*sinkWriter, error) {
+	sw := &sinkWriter{target: target}
+	switch {
+	case target == "-" || target == "":
+		sw.w = os.Stdout
+	case strings.HasPrefix(target, "tcp://"), strings.HasPrefix(target, "udp://"):
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sw.w = f
+	}
+	return sw, nil
+}
+
+// maxDatagram is the payload size UDP writes are split at line boundaries
+const maxDatagram = 1400
+
+func (sw *sinkWriter) Write(data []byte) (int, error) {
+	if sw.w != nil {
+		return sw.w.Write(data)
+	}
+
+	if sw.conn == nil {
+		network, addr := sw.target[:3], sw.target[len("tcp://"):]
+		conn, err := net.DialTimeout(network, addr, 10*time.Second)
+		if err != nil {
+			return 0, err
+		}
+		sw.conn = conn
+	}
+
+	if strings.HasPrefix(sw.target, "tcp://") {
+		n, err := sw.conn.Write(data)
+		if err != nil {
+			sw.conn.Close()
+			sw.conn = nil
+		}
+		return n, err
+	}
+
+	// UDP: send as many whole lines as fit into a datagram
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxDatagram {
+			n = bytes.LastIndexByte(data[:maxDatagram], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+			}
+			if n == 0 {
+				n = len(data)
+			}
+		}
+		if _, err := sw.conn.Write(data[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// runSink is the "sink" command
+func runSink(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("sink", flag.ExitOnError)
+	var format = fs.String("format", "influx", "output format: influx (line protocol) or graphite (plaintext)")
+	var output = fs.String("output", "-", "- for stdout, a file, tcp://host:port or udp://host:port")
+	var interval = fs.Duration("interval", 0, "write the metrics at this interval until interrupted, once if 0")
+	var kinds = fs.String("kinds", "cluster,vm", "comma separated kinds to write: cluster, host, vm, container")
+	var measurements = fs.String("measurements", "", "measurement names (Graphite prefixes) per kind like cluster=ntnx_cluster,vm=ntnx_vm")
+	var tags = fs.String("tags", "", "comma separated labels written as tags, all labels for influx and cluster,host,vm,container for graphite if not set")
+	var extraTags = fs.String("extra-tags", "", "static tags added to every line like env=prod,dc=fra")
+	fs.Parse(args)
+
+	o := sinkOptions{Kinds: make(map[string]bool)}
+	var write func([]metricSample, sinkOptions, time.Time) []byte
+	switch *format {
+	case "influx":
+		write = formatInflux
+	case "graphite":
+		write = formatGraphite
+		o.Tags = []string{"cluster", "host", "vm", "container"}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	for _, k := range strings.Split(*kinds, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			if _, ok := statsKinds[k]; !ok {
+				return fmt.Errorf("unknown kind %q", k)
+			}
+			o.Kinds[k] = true
+		}
+	}
+	if len(o.Kinds) == 0 {
+		return errors.New("-kinds is required")
+	}
+	var err error
+	if o.Measurements, err = parseKeyValues(*measurements); err != nil {
+		return err
+	}
+	if o.ExtraTags, err = parseKeyValues(*extraTags); err != nil {
+		return err
+	}
+	if *tags != "" {
+		o.Tags = strings.Split(*tags, ",")
+	}
+
+	w, err := newSinkWriter(*output)
+	if err != nil {
+		return err
+	}
+
+	// peer hosts of the same cluster report the same entities, their labels
+	// contain the cluster UUID, so a sample is only written for the first
+	flush := func() error {
+		var errs []error
+		seen := make(map[string]bool)
+		for _, s := range c.scrapeMetrics() {
+			if s.Err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", s.Host, s.Err))
+				continue
+			}
+			var samples []metricSample
+			for _, sample := range s.Samples {
+				key := sample.Kind + "." + sample.Name + promLabels(sample.Labels)
+				if o.Kinds[sample.Kind] && !seen[key] {
+					seen[key] = true
+					samples = append(samples, sample)
+				}
+			}
+			if _, err := w.Write(write(samples, o, s.Time)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", *output, err))
+			}
+		}
+		return joinErrors(errs)
+	}
+
+	if *interval <= 0 {
+		return flush()
+	}
+
+	// on schedule errors are logged and the next interval is tried again
+	if err := flush(); err != nil {
+		log.Print(err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func init() {
+	register(command{name: "sink", usage: "write stats as InfluxDB line protocol or Graphite plaintext", run: runSink})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsKinds maps the entity kinds to the v1 API collections with a stats
+// endpoint
+var statsKinds = map[string]string{
+	"cluster":   "clusters",
+	"host":      "hosts",
+	"vm":        "vms",
+	"container": "containers",
+}
+
+// statsEntity is an entity the stats are fetched for
+type statsEntity struct {
+	Kind string
+	UUID string
+	Name string
+}
+
+// statsPoint is a single value of a time series
+type statsPoint struct {
+	Time  time.Time `json:"time"`
+	Value int64     `json:"value"`
+}
+
+// statsSeries is the time series of a metric of an entity
+type statsSeries struct {
+	Kind         string       `json:"kind"`
+	Entity       string       `json:"entity"`
+	UUID         string       `json:"uuid"`
+	Metric       string       `json:"metric"`
+	IntervalSecs int64        `json:"interval_secs"`
+	Points       []statsPoint `json:"points"`
+}
+
+// statsGet is the response of the v1 stats endpoints
+type statsGet struct {
+	StatsSpecificResponses []struct {
+		Successful       bool    `json:"successful"`
+		Message          string  `json:"message"`
+		StartTimeInUsecs int64   `json:"startTimeInUsecs"`
+		IntervalInSecs   int64   `json:"intervalInSecs"`
+		Metric           string  `json:"metric"`
+		Values           []int64 `json:"values"`
+	} `json:"statsSpecificResponses"`
+}
+
+// statsSeries returns the time series of the metrics of the entity between
+// start and end. The -1 values Prism returns for missing samples are skipped.
+func (c *client) statsSeries(e statsEntity, metrics []string, start time.Time, end time.Time, interval time.Duration) ([]statsSeries, error) {
+
+	collection, ok := statsKinds[e.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown kind %q", e.Kind)
+	}
+
+	q := url.Values{}
+	q.Set("metrics", strings.Join(metrics, ","))
+	q.Set("startTimeInUsecs", strconv.FormatInt(start.UnixNano()/1000, 10))
+	q.Set("endTimeInUsecs", strconv.FormatInt(end.UnixNano()/1000, 10))
+	q.Set("intervalInSecs", strconv.Itoa(int(interval/time.Second)))
+
+	var resp statsGet
+	if err := c.get(c.v1("/"+collection+"/"+e.UUID+"/stats/?"+q.Encode()), &resp); err != nil {
+		return nil, err
+	}
+
+	var series []statsSeries
+	for _, r := range resp.StatsSpecificResponses {
+		if !r.Successful {
+			return nil, fmt.Errorf("%s %s: %s: %s", e.Kind, e.Name, r.Metric, r.Message)
+		}
+		step := time.Duration(r.IntervalInSecs) * time.Second
+		s := statsSeries{Kind: e.Kind, Entity: e.Name, UUID: e.UUID, Metric: r.Metric, IntervalSecs: r.IntervalInSecs, Points: []statsPoint{}}
+		t := time.Unix(0, r.StartTimeInUsecs*1000).UTC()
+		for _, v := range r.Values {
+			if v != -1 {
+				s.Points = append(s.Points, statsPoint{Time: t, Value: v})
+			}
+			t = t.Add(step)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// statsEntities returns the entities of kind, all if name is empty
+func (c *client) statsEntities(kind string, name string) ([]statsEntity, error) {
+
+	var all []statsEntity
+	switch kind {
+	case "cluster":
+		clusters, err := c.listClusters()
+		if err != nil {
+			return nil, err
+		}
+		for _, ci := range clusters {
+			all = append(all, statsEntity{kind, ci.UUID, ci.Name})
+		}
+	case "host":
+		hosts, err := c.listHosts()
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			all = append(all, statsEntity{kind, h.UUID, h.Name})
+		}
+	case "vm":
+		vms, err := c.listVMs()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vms {
+			all = append(all, statsEntity{kind, v.UUID, v.Name})
+		}
+	case "container":
+		scs, err := c.listStorageContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, sc := range scs {
+			all = append(all, statsEntity{kind, sc.UUID, sc.Name})
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind %q, use cluster, host, vm or container", kind)
+	}
+
+	if name == "" {
+		return all, nil
+	}
+	var selected []statsEntity
+	for _, e := range all {
+		if e.Name == name || e.UUID == name {
+			selected = append(selected, e)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no %s named %q", kind, name)
+	}
+	return selected, nil
+}
+
+// parseStatsTime parses an RFC 3339 time or a duration before now like "24h"
+func parseStatsTime(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, use RFC 3339 or a duration before now like 24h", s)
+	}
+	return t, nil
+}
+
+// writeStatsCSV writes a row per point
+func writeStatsCSV(w io.Writer, series []statsSeries) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "kind", "entity", "uuid", "metric", "value"})
+	for _, s := range series {
+		for _, p := range s.Points {
+			cw.Write([]string{p.Time.Format(time.RFC3339), s.Kind, s.Entity, s.UUID, s.Metric, strconv.FormatInt(p.Value, 10)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printStats prints every series with its points
+func printStats(series []statsSeries) {
+	for _, s := range series {
+		fmt.Printf("%s %s %s (%d points every %s)\n", s.Kind, s.Entity, s.Metric, len(s.Points), time.Duration(s.IntervalSecs)*time.Second)
+		for _, p := range s.Points {
+			fmt.Printf("  %s  %d\n", p.Time.Format(time.RFC3339), p.Value)
+		}
+	}
+}
+
+// runStats is the "stats" command
+func runStats(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var kind = fs.String("kind", "cluster", "entity kind: cluster, host, vm or container")
+	var name = fs.String("name", "", "name or UUID of the entity, all entities of kind if not set")
+	var metrics = fs.String("metrics", "hypervisor_cpu_usage_ppm,hypervisor_memory_usage_ppm", "comma separated metric names")
+	var start = fs.String("start", "1h", "start time, RFC 3339 or a duration before now")
+	var end = fs.String("end", "now", "end time, RFC 3339 or a duration before now")
+	var interval = fs.Duration("interval", 5*time.Minute, "interval between the points")
+	var csvOut = fs.Bool("csv", false, "print the series as CSV")
+	var jsonOut = fs.Bool("json", false, "print the series as JSON")
+	fs.Parse(args)
+
+	now := time.Now()
+	from, err := parseStatsTime(*start, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseStatsTime(*end, now)
+	if err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return errors.New("-start must be before -end")
+	}
+	if *interval < time.Second {
+		return errors.New("-interval must be at least 1s")
+	}
+
+	entities, err := c.statsEntities(*kind, *name)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, m := range strings.Split(*metrics, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			names = append(names, m)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("-metrics is required")
+	}
+
+	series := []statsSeries{}
+	for _, e := range entities {
+		s, err := c.statsSeries(e, names, from, to, *interval)
+		if err != nil {
+			return err
+		}
+		series = append(series, s...)
+	}
+
+	switch {
+	case *csvOut:
+		return writeStatsCSV(os.Stdout, series)
+	case *jsonOut:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(series)
+	}
+	printStats(series)
+	return nil
+}
+
+func init() {
+	register(command{name: "stats", usage: "fetch the stats time series of clusters, hosts, VMs or containers", run: runStats})
+}
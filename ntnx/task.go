@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// taskPollInterval is the time between two polls of a running task
+var taskPollInterval = 2 * time.Second
+
+// taskResponse is the response of all v2 calls which are executed as a task
+type taskResponse struct {
+	TaskUUID string `json:"task_uuid"`
+}
+
+// taskV2 is the part of the v2 /tasks/{uuid} response needed to follow a task
+type taskV2 struct {
+	UUID               string `json:"uuid"`
+	OperationType      string `json:"operation_type"`
+	ProgressStatus     string `json:"progress_status"`
+	PercentageComplete int    `json:"percentage_complete"`
+	MetaResponse       struct {
+		ErrorCode   int    `json:"error_code"`
+		ErrorDetail string `json:"error_detail"`
+	} `json:"meta_response"`
+	EntityList []struct {
+		EntityID   string `json:"entity_id"`
+		EntityType string `json:"entity_type"`
+	} `json:"entity_list"`
+}
+
+// taskV3 is the part of the v3 /tasks/{uuid} response needed to follow a task
+type taskV3 struct {
+	UUID                string `json:"uuid"`
+	Status              string `json:"status"`
+	ErrorDetail         string `json:"error_detail"`
+	PercentageComplete  int    `json:"percentage_complete"`
+	EntityReferenceList []struct {
+		Kind string `json:"kind"`
+		UUID string `json:"uuid"`
+	} `json:"entity_reference_list"`
+}
+
+// errTaskTimeout is returned if a task did not finish in time
+var errTaskTimeout = errors.New("timeout waiting for task")
+
+// errTaskFailed is returned if a task failed or was aborted
+var errTaskFailed = errors.New("task failed")
+
+// waitTask polls the v2 task until it succeeded, failed or the timeout is reached
+func (c *client) waitTask(uuid string, timeout time.Duration) (*taskV2, error) {
+
+	if uuid == "" {
+		return nil, errors.New("no task uuid returned")
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var t taskV2
+		if err := c.get(c.v2("/tasks/"+uuid), &t); err != nil {
+			return nil, err
+		}
+
+		switch t.ProgressStatus {
+		case "Succeeded":
+			return &t, nil
+		case "Failed", "Aborted":
+			return &t, fmt.Errorf("%w: %s (%s): %s", errTaskFailed, uuid, strings.ToLower(t.ProgressStatus), t.MetaResponse.ErrorDetail)
+		}
+
+		if time.Now().After(deadline) {
+			return &t, fmt.Errorf("%w %s after %s", errTaskTimeout, uuid, timeout)
+		}
+
+		time.Sleep(taskPollInterval)
+	}
+}
+
+// waitTaskV3 polls the v3 task until it succeeded, failed or the timeout is reached
+func (c *client) waitTaskV3(uuid string, timeout time.Duration) (*taskV3, error) {
+
+	if uuid == "" {
+		return nil, errors.New("no task uuid returned")
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var t taskV3
+		if err := c.get(c.v3("/tasks/"+uuid), &t); err != nil {
+			return nil, err
+		}
+
+		switch t.Status {
+		case "SUCCEEDED":
+			return &t, nil
+		case "FAILED", "ABORTED":
+			return &t, fmt.Errorf("%w: %s (%s): %s", errTaskFailed, uuid, strings.ToLower(t.Status), t.ErrorDetail)
+		}
+
+		if time.Now().After(deadline) {
+			return &t, fmt.Errorf("%w %s after %s", errTaskTimeout, uuid, timeout)
+		}
+
+		time.Sleep(taskPollInterval)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// topologySlot is a chassis position of a block and the host in it
+type topologySlot struct {
+	Position          string `json:"position"`
+	NodeID            int    `json:"node_id,omitempty"`
+	HostUUID          string `json:"host_uuid"`
+	Host              string `json:"host"`
+	HostSerial        string `json:"host_serial,omitempty"`
+	HypervisorAddress string `json:"hypervisor_address,omitempty"`
+	CVMAddress        string `json:"cvm_address,omitempty"`
+	IPMIAddress       string `json:"ipmi_address,omitempty"`
+	State             string `json:"state,omitempty"`
+}
+
+// topologyBlock is a block (rackable unit) with its slots
+type topologyBlock struct {
+	Serial    string         `json:"serial"`
+	Model     string         `json:"model"`
+	ModelName string         `json:"model_name"`
+	Slots     []topologySlot `json:"slots"`
+}
+
+// topologyCluster are the blocks of a cluster
+type topologyCluster struct {
+	Cluster string          `json:"cluster"`
+	UUID    string          `json:"uuid"`
+	Blocks  []topologyBlock `json:"blocks"`
+}
+
+// newSlot returns the slot at position with the host h, h may be nil for a
+// node the hosts API does not know
+func newSlot(position string, nodeID int, uuid string, h *host) topologySlot {
+	s := topologySlot{Position: position, NodeID: nodeID, HostUUID: uuid}
+	if h != nil {
+		s.HostUUID = h.UUID
+		s.Host = h.Name
+		s.HostSerial = h.Serial
+		s.HypervisorAddress = h.HypervisorAddress
+		s.CVMAddress = h.CVMAddress
+		s.IPMIAddress = h.IPMIAddress
+		s.State = h.State
+	}
+	return s
+}
+
+// hostPosition returns the position of the host in its block, the name
+// if known else the ordinal
+func hostPosition(h host) string {
+	if h.Position.Name != "" {
+		return h.Position.Name
+	}
+	return strconv.Itoa(h.Position.Ordinal)
+}
+
+// positionLess orders positions numerically if both are numbers like "2"
+// and "10", else by name like "A" and "B"
+func positionLess(a string, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// topology joins the rackable units of the cluster with the hosts. Blocks
+// which are only in BlockSerials and hosts in no rackable unit are placed
+// by the block serial and position of the host.
+func topology(ci clusterInfo, hosts []host) topologyCluster {
+
+	t := topologyCluster{Cluster: ci.Name, UUID: ci.UUID}
+	byUUID := make(map[string]*host)
+	for i := range hosts {
+		byUUID[hosts[i].UUID] = &hosts[i]
+	}
+	placed := make(map[string]bool)
+
+	blocks := make(map[string]*topologyBlock)
+	var serials []string
+	block := func(serial string) *topologyBlock {
+		b, ok := blocks[serial]
+		if !ok {
+			b = &topologyBlock{Serial: serial}
+			blocks[serial] = b
+			serials = append(serials, serial)
+		}
+		return b
+	}
+
+	for _, ru := range ci.RackableUnits {
+		b := block(ru.Serial)
+		b.Model, b.ModelName = ru.Model, ru.ModelName
+		for i, pos := range ru.Positions {
+			var nodeID int
+			var uuid string
+			if i < len(ru.Nodes) {
+				nodeID = ru.Nodes[i]
+			}
+			if i < len(ru.NodeUuids) {
+				uuid = ru.NodeUuids[i]
+			}
+			b.Slots = append(b.Slots, newSlot(pos, nodeID, uuid, byUUID[uuid]))
+			placed[uuid] = true
+		}
+	}
+	for _, serial := range ci.BlockSerials {
+		block(serial)
+	}
+	for i, h := range hosts {
+		if placed[h.UUID] {
+			continue
+		}
+		b := block(h.BlockSerial)
+		if b.ModelName == "" {
+			b.ModelName = h.BlockModelName
+		}
+		b.Slots = append(b.Slots, newSlot(hostPosition(h), 0, h.UUID, &hosts[i]))
+	}
+
+	sort.Strings(serials)
+	for _, serial := range serials {
+		b := blocks[serial]
+		sort.SliceStable(b.Slots, func(i, j int) bool { return positionLess(b.Slots[i].Position, b.Slots[j].Position) })
+		t.Blocks = append(t.Blocks, *b)
+	}
+	return t
+}
+
+// printTopology prints each block with its positions and hosts
+func printTopology(clusters []topologyCluster) {
+	for _, t := range clusters {
+		fmt.Printf("cluster %s\n", t.Cluster)
+		for _, b := range t.Blocks {
+			fmt.Printf("  block %s %s\n", orNone(b.Serial), b.ModelName)
+			if len(b.Slots) == 0 {
+				fmt.Println("    no nodes")
+			}
+			for _, s := range b.Slots {
+				fmt.Printf("    position %-3s %-16s hypervisor %-15s cvm %-15s ipmi %-15s %s\n",
+					s.Position, orNone(s.Host), orNone(s.HypervisorAddress), orNone(s.CVMAddress), orNone(s.IPMIAddress), s.State)
+			}
+		}
+	}
+}
+
+// dotQuote quotes s as DOT string. Backslashes are kept because they are
+// the escapes of the labels.
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// recordEscape escapes the characters with a meaning in record labels
+var recordEscape = strings.NewReplacer("{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`)
+
+// printTopologyDOT prints the topology as Graphviz graph with a subgraph per
+// cluster and block and a record node per slot
+func printTopologyDOT(clusters []topologyCluster) {
+	fmt.Println("graph topology {")
+	fmt.Println("  node [shape=record, fontname=Helvetica];")
+	fmt.Println("  graph [fontname=Helvetica];")
+	for ci, t := range clusters {
+		fmt.Printf("  subgraph cluster_%d {\n", ci)
+		fmt.Printf("    label=%s;\n", dotQuote("cluster "+t.Cluster))
+		for bi, b := range t.Blocks {
+			fmt.Printf("    subgraph cluster_%d_%d {\n", ci, bi)
+			fmt.Printf("      label=%s;\n", dotQuote(strings.TrimSpace(b.Serial+" "+b.ModelName)))
+			for si, s := range b.Slots {
+				var fields []string
+				for _, f := range []string{"position " + s.Position, orNone(s.Host), "hypervisor " + orNone(s.HypervisorAddress),
+					"cvm " + orNone(s.CVMAddress), "ipmi " + orNone(s.IPMIAddress)} {
+					fields = append(fields, recordEscape.Replace(f))
+				}
+				label := "{" + strings.Join(fields, "|") + "}"
+				fmt.Printf("      n%d_%d_%d [label=%s];\n", ci, bi, si, dotQuote(label))
+			}
+			if len(b.Slots) == 0 {
+				fmt.Printf("      n%d_%d_empty [label=\"no nodes\", shape=plaintext];\n", ci, bi)
+			}
+			fmt.Println("    }")
+		}
+		fmt.Println("  }")
+	}
+	fmt.Println("}")
+}
+
+// runClusterTopology is the "cluster topology" command
+func runClusterTopology(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster topology", flag.ExitOnError)
+	var format = fs.String("format", "text", "output format: text, json or dot")
+	fs.Parse(args)
+
+	switch *format {
+	case "text", "json", "dot":
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	out := []topologyCluster{}
+	for _, cc := range c.all() {
+		clusters, err := cc.listClusters()
+		if err != nil {
+			return err
+		}
+		hosts, err := cc.listHosts()
+		if err != nil {
+			return err
+		}
+		for _, ci := range clusters {
+			var ch []host
+			for _, h := range hosts {
+				if h.ClusterUUID == ci.UUID || h.ClusterUUID == "" && len(clusters) == 1 {
+					ch = append(ch, h)
+				}
+			}
+			out = append(out, topology(ci, ch))
+		}
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "dot":
+		printTopologyDOT(out)
+	default:
+		printTopology(out)
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "cluster topology", usage: "show the blocks, positions and hosts of the clusters", run: runClusterTopology})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPositionLess(t *testing.T) {
+
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"1", "2", true},
+		{"2", "10", true},
+		{"10", "2", false},
+		{"2", "2", false},
+		{"A", "B", true},
+		{"B", "A", false},
+		{"10", "A", true},
+		{"A", "10", false},
+	} {
+		if got := positionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("positionLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+
+	ci := clusterInfo{
+		Name:         "lab",
+		UUID:         "cl1",
+		BlockSerials: []string{"B1", "B2"},
+		RackableUnits: []rackableUnit{{
+			Serial:    "B1",
+			ModelName: "NX-3060",
+			Positions: []string{"10", "2"},
+			Nodes:     []int{10, 2},
+			NodeUuids: []string{"h10", "h2"},
+		}},
+	}
+	hosts := []host{
+		{UUID: "h2", Name: "node-2"},
+		{UUID: "h10", Name: "node-10"},
+		{UUID: "h3", Name: "node-3", BlockSerial: "B3", BlockModelName: "NX-1065"},
+	}
+	hosts[2].Position.Ordinal = 1
+
+	// one line per block like "serial: model position=host,..."
+	var got []string
+	for _, b := range topology(ci, hosts).Blocks {
+		var slots []string
+		for _, s := range b.Slots {
+			slots = append(slots, s.Position+"="+s.Host)
+		}
+		got = append(got, b.Serial+": "+b.ModelName+" "+strings.Join(slots, ","))
+	}
+	want := []string{
+		"B1: NX-3060 2=node-2,10=node-10",
+		"B2:  ",
+		"B3: NX-1065 1=node-3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resizeOptions are the new vCPU, cores and memory of a VM. Zero values keep
+// the current configuration.
+type resizeOptions struct {
+	Vcpus      int
+	Cores      int
+	MemoryMB   int
+	PowerCycle bool
+	ForceAfter time.Duration
+	Timeout    time.Duration
+}
+
+// vmUpdateRequest is the body of a v2 PUT /vms/{uuid}
+type vmUpdateRequest struct {
+	Name            string `json:"name"`
+	MemoryMB        int    `json:"memory_mb,omitempty"`
+	NumVcpus        int    `json:"num_vcpus,omitempty"`
+	NumCoresPerVcpu int    `json:"num_cores_per_vcpu,omitempty"`
+}
+
+// hotPluggable returns true if the change can be applied to the running VM.
+// AHV can add memory and vCPUs, all other changes require a power off.
+func (o resizeOptions) hotPluggable(v vm, h *host) bool {
+	if h == nil || h.HypervisorType != "kKvm" {
+		return false
+	}
+	if o.Cores != 0 && o.Cores != v.NumCoresPerVcpu {
+		return false
+	}
+	if o.Vcpus != 0 && o.Vcpus < v.NumVcpus {
+		return false
+	}
+	if o.MemoryMB != 0 && o.MemoryMB < v.MemoryMB {
+		return false
+	}
+	return true
+}
+
+// validate checks that the options change anything and that the forced
+// power off happens before the timeout
+func (o resizeOptions) validate() error {
+	if o.Vcpus == 0 && o.Cores == 0 && o.MemoryMB == 0 {
+		return errors.New("one of -vcpus, -cores or -memory-mb is required")
+	}
+	if o.ForceAfter > 0 && o.ForceAfter >= o.Timeout {
+		return errors.New("-force-after has to be shorter than -timeout")
+	}
+	return nil
+}
+
+// changed returns true if the options change anything of v
+func (o resizeOptions) changed(v vm) bool {
+	return o.Vcpus != 0 && o.Vcpus != v.NumVcpus ||
+		o.Cores != 0 && o.Cores != v.NumCoresPerVcpu ||
+		o.MemoryMB != 0 && o.MemoryMB != v.MemoryMB
+}
+
+// updateVM sends the update request and waits for the task
+func (c *client) updateVM(uuid string, req interface{}, timeout time.Duration) error {
+	var resp taskResponse
+	if err := c.put(c.v2("/vms/"+uuid), req, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// resizeVM changes vCPUs, cores and memory of the VM. A running VM is changed
+// with hot-add if possible, otherwise it is only power cycled if allowed.
+func (c *client) resizeVM(v vm, o resizeOptions) error {
+
+	if !o.changed(v) {
+		return nil
+	}
+
+	var h *host
+	hosts, err := c.listHosts()
+	if err != nil {
+		return err
+	}
+	for i := range hosts {
+		if hosts[i].UUID == v.HostUUID {
+			h = &hosts[i]
+		}
+	}
+
+	running := v.PowerState == "on"
+	cycle := running && !o.hotPluggable(v, h)
+
+	if cycle && !o.PowerCycle {
+		return errors.New("the change can not be hot-added to the running VM, use -power-cycle to shut it down")
+	}
+	if running && !cycle {
+		if err := c.requireAOS("hot-add"); err != nil {
+			return err
+		}
+	}
+
+	if cycle {
+		po := powerOptions{State: "shutdown", API: "v2", Timeout: o.Timeout, ForceAfter: o.ForceAfter}
+		if err := c.powerVM(v, po); err != nil {
+			return err
+		}
+	}
+
+	req := vmUpdateRequest{Name: v.Name, MemoryMB: o.MemoryMB, NumVcpus: o.Vcpus, NumCoresPerVcpu: o.Cores}
+	err = c.updateVM(v.UUID, req, o.Timeout)
+
+	// the VM is powered on again even if the update failed
+	if cycle {
+		if perr := c.powerVM(v, powerOptions{State: "on", API: "v2", Timeout: o.Timeout}); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// verify the new configuration
+	nv, err := c.getVM(v.UUID)
+	if err != nil {
+		return err
+	}
+	if o.changed(*nv) {
+		return fmt.Errorf("VM has %d vCPUs, %d cores, %d MB after the update", nv.NumVcpus, nv.NumCoresPerVcpu, nv.MemoryMB)
+	}
+	return nil
+}
+
+// parseDiskAddress parses a disk address like scsi.1
+func parseDiskAddress(s string) (string, int, error) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("disk address %q has to be bus.index like scsi.1", s)
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("disk address %q has to be bus.index like scsi.1", s)
+	}
+	return parts[0], i, nil
+}
+
+// findDisk returns the disk of the VM at the address
+func findDisk(v vm, address string) (*vmDisk, error) {
+	bus, index, err := parseDiskAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range v.VMDiskInfo {
+		if d.DiskAddress.DeviceBus == bus && d.DiskAddress.DeviceIndex == index {
+			return &v.VMDiskInfo[i], nil
+		}
+	}
+	return nil, fmt.Errorf("VM %s has no disk %s", v.Name, address)
+}
+
+// diskTask sends a disk attach, detach or update and waits for the task
+func (c *client) diskTask(method string, v vm, action string, disks []vmDiskRequest, timeout time.Duration) error {
+	var resp taskResponse
+	body := map[string]interface{}{"vm_disks": disks}
+	if err := c.do(method, c.v2("/vms/"+v.UUID+"/disks/"+action), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// nicTask sends a NIC add (empty mac), update or remove and waits for the task
+func (c *client) nicTask(method string, v vm, mac string, body interface{}, timeout time.Duration) error {
+	var resp taskResponse
+	if err := c.do(method, c.v2("/vms/"+v.UUID+"/nics/"+mac), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.waitTask(resp.TaskUUID, timeout)
+	return err
+}
+
+// runVMResize is the "vm resize" command
+func runVMResize(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm resize", flag.ExitOnError)
+	var s vmSelector
+	var o resizeOptions
+	s.addFlags(fs)
+	fs.IntVar(&o.Vcpus, "vcpus", 0, "new number of vCPUs")
+	fs.IntVar(&o.Cores, "cores", 0, "new number of cores per vCPU")
+	fs.IntVar(&o.MemoryMB, "memory-mb", 0, "new memory in MB")
+	fs.BoolVar(&o.PowerCycle, "power-cycle", false, "shut down and power on the VM if the change can not be hot-added")
+	fs.DurationVar(&o.ForceAfter, "force-after", 2*time.Minute, "power off the VM if the shutdown did not finish in this time")
+	fs.DurationVar(&o.Timeout, "timeout", 10*time.Minute, "time to wait for each task")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+
+	return forEachVM(vms, func(v vm) (string, error) {
+		if !o.changed(v) {
+			return "unchanged", nil
+		}
+		return "resized", c.resizeVM(v, o)
+	})
+}
+
+// runVMDisk is the "vm disk" command
+func runVMDisk(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm disk", flag.ExitOnError)
+	var s vmSelector
+	s.addFlags(fs)
+	var attach = fs.Bool("attach", false, "attach a new empty disk of -size-gb on -container")
+	var detach = fs.String("detach", "", "detach and delete the disk at bus.index, e.g. scsi.1")
+	var grow = fs.String("grow", "", "grow the disk at bus.index to -size-gb")
+	var container = fs.String("container", "", "storage container of the new disk")
+	var sizeGB = fs.Int64("size-gb", 0, "size of the new or grown disk in GiB")
+	var bus = fs.String("bus", "scsi", "bus of the new disk")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for each task")
+	fs.Parse(args)
+
+	n := 0
+	for _, set := range []bool{*attach, *detach != "", *grow != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of -attach, -detach or -grow is required")
+	}
+
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *attach:
+		r, err := c.loadResources()
+		if err != nil {
+			return err
+		}
+		d := diskSpec{Container: *container, SizeGB: *sizeGB, Bus: *bus}
+		if err := joinErrors(d.validate(0, r)); err != nil {
+			return err
+		}
+
+		return forEachVM(vms, func(v vm) (string, error) {
+			// the new disk receives the next free index on the bus
+			req := diskRequests([]diskSpec{d}, r)[0]
+			for _, old := range v.VMDiskInfo {
+				if old.DiskAddress.DeviceBus == d.Bus && old.DiskAddress.DeviceIndex >= req.DiskAddress.DeviceIndex {
+					req.DiskAddress.DeviceIndex = old.DiskAddress.DeviceIndex + 1
+				}
+			}
+			if err := c.diskTask("POST", v, "attach", []vmDiskRequest{req}, *timeout); err != nil {
+				return "", err
+			}
+			address := fmt.Sprintf("%s.%d", req.DiskAddress.DeviceBus, req.DiskAddress.DeviceIndex)
+			nv, err := c.getVM(v.UUID)
+			if err != nil {
+				return "", err
+			}
+			if _, err := findDisk(*nv, address); err != nil {
+				return "", err
+			}
+			return "attached " + address, nil
+		})
+
+	case *detach != "":
+		return forEachVM(vms, func(v vm) (string, error) {
+			d, err := findDisk(v, *detach)
+			if err != nil {
+				return "", err
+			}
+			addr := d.DiskAddress
+			req := vmDiskRequest{IsCdrom: d.IsCdrom, DiskAddress: &diskAddress{
+				DeviceBus: addr.DeviceBus, DeviceIndex: addr.DeviceIndex, VMDiskUUID: addr.VMDiskUUID}}
+			if err := c.diskTask("POST", v, "detach", []vmDiskRequest{req}, *timeout); err != nil {
+				return "", err
+			}
+			nv, err := c.getVM(v.UUID)
+			if err != nil {
+				return "", err
+			}
+			if _, err := findDisk(*nv, *detach); err == nil {
+				return "", errors.New("disk " + *detach + " is still attached")
+			}
+			return "detached " + *detach, nil
+		})
+	}
+
+	return forEachVM(vms, func(v vm) (string, error) {
+		d, err := findDisk(v, *grow)
+		if err != nil {
+			return "", err
+		}
+		size := *sizeGB << 30
+		if size <= d.Size {
+			return "", fmt.Errorf("disk %s has already %d GiB, disks can only grow", *grow, d.Size>>30)
+		}
+		addr := d.DiskAddress
+		req := vmDiskRequest{
+			DiskAddress:  &diskAddress{DeviceBus: addr.DeviceBus, DeviceIndex: addr.DeviceIndex, VMDiskUUID: addr.VMDiskUUID},
+			VMDiskCreate: &vmDiskCreate{StorageContainerUUID: d.StorageContainerUUID, Size: size},
+		}
+		if err := c.diskTask("PUT", v, "update", []vmDiskRequest{req}, *timeout); err != nil {
+			return "", err
+		}
+		nv, err := c.getVM(v.UUID)
+		if err != nil {
+			return "", err
+		}
+		if nd, err := findDisk(*nv, *grow); err != nil || nd.Size < size {
+			return "", errors.New("disk " + *grow + " did not grow")
+		}
+		return fmt.Sprintf("grown %s to %d GiB", *grow, *sizeGB), nil
+	})
+}
+
+// findNic returns the NIC of the VM with the MAC address
+func findNic(v vm, mac string) (*vmNic, error) {
+	for i, n := range v.VMNics {
+		if strings.EqualFold(n.MacAddress, mac) {
+			return &v.VMNics[i], nil
+		}
+	}
+	return nil, fmt.Errorf("VM %s has no NIC %s", v.Name, mac)
+}
+
+// runVMNic is the "vm nic" command
+func runVMNic(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("vm nic", flag.ExitOnError)
+	var s vmSelector
+	s.addFlags(fs)
+	var add = fs.Bool("add", false, "add a NIC on -network")
+	var remove = fs.String("remove", "", "remove the NIC with the MAC address")
+	var change = fs.String("change", "", "move the NIC with the MAC address to -network")
+	var networkName = fs.String("network", "", "network of the new or changed NIC")
+	var ip = fs.String("ip", "", "static IP of the new or changed NIC")
+	var timeout = fs.Duration("timeout", 10*time.Minute, "time to wait for each task")
+	fs.Parse(args)
+
+	n := 0
+	for _, set := range []bool{*add, *remove != "", *change != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of -add, -remove or -change is required")
+	}
+
+	vms, err := c.selectVMs(s)
+	if err != nil {
+		return err
+	}
+
+	if *remove != "" {
+		return forEachVM(vms, func(v vm) (string, error) {
+			if err := c.nicTask("DELETE", v, *remove, nil, *timeout); err != nil {
+				return "", err
+			}
+			nv, err := c.getVM(v.UUID)
+			if err != nil {
+				return "", err
+			}
+			if _, err := findNic(*nv, *remove); err == nil {
+				return "", errors.New("NIC " + *remove + " still exists")
+			}
+			return "removed NIC " + *remove, nil
+		})
+	}
+
+	r, err := c.loadResources()
+	if err != nil {
+		return err
+	}
+	spec := nicSpec{Network: *networkName, IP: *ip}
+	if err := joinErrors(spec.validate(0, r)); err != nil {
+		return err
+	}
+	req := nicRequests([]nicSpec{spec}, r)[0]
+
+	return forEachVM(vms, func(v vm) (string, error) {
+
+		// the MACs before the add tell the new NIC apart from existing ones
+		before := make(map[string]bool)
+		for _, n := range v.VMNics {
+			before[strings.ToLower(n.MacAddress)] = true
+		}
+
+		var err error
+		if *add {
+			err = c.nicTask("POST", v, "", map[string]interface{}{"spec_list": []vmNicRequest{req}}, *timeout)
+		} else {
+			if _, err := findNic(v, *change); err != nil {
+				return "", err
+			}
+			err = c.nicTask("PUT", v, *change, map[string]interface{}{"nic_spec": req}, *timeout)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// verify the added NIC or the changed NIC is on the network
+		nv, err := c.getVM(v.UUID)
+		if err != nil {
+			return "", err
+		}
+		for _, n := range nv.VMNics {
+			if n.NetworkUUID != req.NetworkUUID {
+				continue
+			}
+			switch {
+			case *add && !before[strings.ToLower(n.MacAddress)]:
+				return "added NIC " + n.MacAddress + " on " + *networkName, nil
+			case !*add && strings.EqualFold(n.MacAddress, *change):
+				return "moved NIC " + n.MacAddress + " to " + *networkName, nil
+			}
+		}
+		if *add {
+			return "", errors.New("no new NIC on network " + *networkName + " after the update")
+		}
+		return "", errors.New("NIC " + *change + " is not on network " + *networkName + " after the update")
+	})
+}
+
+// forEachVM runs fn for all VMs, prints the result of each VM and returns an
+// error if any of them failed
+func forEachVM(vms []vm, fn func(v vm) (string, error)) error {
+	failed := 0
+	for _, v := range vms {
+		msg, err := fn(v)
+		if err != nil {
+			fmt.Printf("%s: %v\n", v.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %s\n", v.Name, msg)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d VMs failed", failed, len(vms))
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "vm resize", usage: "change vCPUs, cores and memory of VMs", run: runVMResize})
+	register(command{name: "vm disk", usage: "attach, detach or grow disks of VMs", run: runVMDisk})
+	register(command{name: "vm nic", usage: "add, remove or change the network of NICs of VMs", run: runVMNic})
+}
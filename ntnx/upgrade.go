@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkStatus is the result of a pre-check
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// precheck is a single item of the checklist
+type precheck struct {
+	Name   string      `json:"name"`
+	Status checkStatus `json:"status"`
+	Detail string      `json:"detail"`
+}
+
+// precheckReport is the checklist of a cluster
+type precheckReport struct {
+	Cluster string     `json:"cluster"`
+	Version string     `json:"version"`
+	Target  string     `json:"target"`
+	Checks  []precheck `json:"checks"`
+}
+
+// count returns the number of checks with status s
+func (r precheckReport) count(s checkStatus) int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// upgradeOptions are the parameters of the pre-check, a nil MinNCC skips
+// the NCC check
+type upgradeOptions struct {
+	Target aosVersion
+	MinNCC *aosVersion
+}
+
+// upgradePrecheck validates the cluster for an upgrade to the target AOS
+// version. hosts and alerts must be the hosts and unresolved alerts of the
+// cluster.
+func upgradePrecheck(ci clusterInfo, hosts []host, alerts []alert, o upgradeOptions) precheckReport {
+
+	r := precheckReport{Cluster: ci.Name, Version: ci.Version, Target: o.Target.String()}
+	add := func(name string, status checkStatus, format string, args ...interface{}) {
+		r.Checks = append(r.Checks, precheck{name, status, fmt.Sprintf(format, args...)})
+	}
+
+	current, err := ci.aosVersion()
+	switch cmp := o.Target.Compare(current); {
+	case err != nil:
+		add("target version", checkWarn, "%v, the upgrade path can not be checked", err)
+	case cmp > 0:
+		add("target version", checkPass, "upgrade from %s to %s", ci.Version, o.Target)
+	case cmp == 0:
+		add("target version", checkFail, "cluster already runs %s", ci.Version)
+	default:
+		add("target version", checkFail, "%s is older than the running %s, downgrades are not supported", o.Target, ci.Version)
+	}
+
+	if ci.IsUpgradeInProgress {
+		add("no upgrade in progress", checkFail, "an upgrade is in progress")
+	} else {
+		add("no upgrade in progress", checkPass, "no upgrade is running")
+	}
+
+	rs := ci.ClusterRedundancyState
+	if rs.CurrentRedundancyFactor >= rs.DesiredRedundancyFactor {
+		add("redundancy factor", checkPass, "current RF%d, desired RF%d", rs.CurrentRedundancyFactor, rs.DesiredRedundancyFactor)
+	} else {
+		add("redundancy factor", checkFail, "current RF%d is below the desired RF%d, the cluster is not fault tolerant", rs.CurrentRedundancyFactor, rs.DesiredRedundancyFactor)
+	}
+
+	// a rolling upgrade needs enough nodes to keep the data available
+	if ci.NumNodes >= 3 {
+		add("node count", checkPass, "%d nodes", ci.NumNodes)
+	} else {
+		add("node count", checkWarn, "%d nodes, the upgrade is disruptive for one and two node clusters", ci.NumNodes)
+	}
+
+	var down []string
+	for _, h := range hosts {
+		if h.State != "NORMAL" {
+			down = append(down, h.Name+" ("+h.State+")")
+		}
+	}
+	switch {
+	case len(down) > 0:
+		add("hosts up", checkFail, "not up: %s", strings.Join(down, ", "))
+	case len(hosts) != ci.NumNodes:
+		add("hosts up", checkWarn, "%d hosts found for %d nodes", len(hosts), ci.NumNodes)
+	default:
+		add("hosts up", checkPass, "all %d hosts are up", len(hosts))
+	}
+
+	var critical, warning []string
+	for _, a := range alerts {
+		switch a.severity() {
+		case "critical":
+			critical = append(critical, a.title())
+		case "warning":
+			warning = append(warning, a.title())
+		}
+	}
+	switch {
+	case len(critical) > 0:
+		add("no critical alerts", checkFail, "%d critical alerts: %s", len(critical), strings.Join(critical, "; "))
+	case len(warning) > 0:
+		add("no critical alerts", checkWarn, "%d warning alerts: %s", len(warning), strings.Join(warning, "; "))
+	default:
+		add("no critical alerts", checkPass, "no unresolved critical or warning alerts")
+	}
+
+	ncc, err := parseAOSVersion(ci.NccVersion)
+	switch {
+	case o.MinNCC == nil:
+	case err != nil:
+		add("ncc version", checkWarn, "NCC version %q unknown, %s or newer is required", ci.NccVersion, o.MinNCC)
+	case !ncc.AtLeast(*o.MinNCC):
+		add("ncc version", checkFail, "NCC %s is older than %s, upgrade NCC first", ncc, o.MinNCC)
+	default:
+		add("ncc version", checkPass, "NCC %s", ncc)
+	}
+
+	return r
+}
+
+// runClusterPrecheck is the "cluster precheck" command
+func runClusterPrecheck(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("cluster precheck", flag.ExitOnError)
+	var target = fs.String("target", "", "target AOS version like 5.10.2")
+	var minNCC = fs.String("min-ncc", "3.10.0", "minimum NCC version, empty to skip the check")
+	var strict = fs.Bool("strict", false, "fail on warnings too")
+	var jsonOut = fs.Bool("json", false, "print the checklist as JSON")
+	fs.Parse(args)
+
+	if *target == "" {
+		return errors.New("-target is required")
+	}
+	var o upgradeOptions
+	var err error
+	if o.Target, err = parseAOSVersion(*target); err != nil {
+		return err
+	}
+	if *minNCC != "" {
+		min, err := parseAOSVersion(*minNCC)
+		if err != nil {
+			return err
+		}
+		o.MinNCC = &min
+	}
+
+	// a cluster reached through several peers is checked once
+	reports := []precheckReport{}
+	seen := make(map[string]bool)
+	for _, cc := range c.all() {
+		clusters, err := cc.listClusters()
+		if err != nil {
+			return err
+		}
+		hosts, err := cc.listHosts()
+		if err != nil {
+			return err
+		}
+		alerts, err := cc.listAlerts(false)
+		if err != nil {
+			return err
+		}
+
+		// a Prism Element may not send the cluster UUID, its entities
+		// belong to its single cluster then
+		belongs := func(ci clusterInfo, uuid string) bool {
+			return uuid == ci.UUID || uuid == "" && len(clusters) == 1
+		}
+		for _, ci := range clusters {
+			if seen[ci.UUID] {
+				continue
+			}
+			seen[ci.UUID] = true
+			var ch []host
+			for _, h := range hosts {
+				if belongs(ci, h.ClusterUUID) {
+					ch = append(ch, h)
+				}
+			}
+			var ca []alert
+			for _, a := range alerts {
+				if belongs(ci, a.ClusterUUID) {
+					ca = append(ca, a)
+				}
+			}
+			reports = append(reports, upgradePrecheck(ci, ch, ca, o))
+		}
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	} else {
+		for _, r := range reports {
+			fmt.Printf("%s: %s -> %s\n", r.Cluster, r.Version, r.Target)
+			for _, c := range r.Checks {
+				fmt.Printf("  [%s] %-24s %s\n", c.Status, c.Name, c.Detail)
+			}
+		}
+	}
+
+	var failed []string
+	for _, r := range reports {
+		if r.count(checkFail) > 0 || *strict && r.count(checkWarn) > 0 {
+			failed = append(failed, r.Cluster)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("not ready for the upgrade: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "cluster precheck", usage: "check the clusters are ready for an AOS upgrade", run: runClusterPrecheck})
+}
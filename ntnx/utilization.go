@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hypervisorStats maps the hypervisor types of the API to the name used in
+// the hypervisor specific stats and a display name
+var hypervisorStats = map[string]struct{ stat, name string }{
+	"kKvm":    {"kvm", "AHV"},
+	"kVMware": {"esx", "ESXi"},
+	"kHyperv": {"hyperv", "Hyper-V"},
+}
+
+// utilization is the CPU and memory utilization of a cluster or host
+// independent of the hypervisor
+type utilization struct {
+	Kind          string  `json:"kind"`
+	Name          string  `json:"name"`
+	Cluster       string  `json:"cluster"`
+	Hypervisor    string  `json:"hypervisor"`
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryPercent float64 `json:"memory_percent"`
+	CPUStat       string  `json:"cpu_stat"`
+	MemoryStat    string  `json:"memory_stat"`
+}
+
+// hypervisorName returns the display names of the hypervisor types, "mixed"
+// for more than one
+func hypervisorName(types []string) string {
+	var names []string
+	for _, t := range types {
+		if h, ok := hypervisorStats[t]; ok {
+			names = append(names, h.name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "unknown"
+	case 1:
+		return names[0]
+	}
+	return "mixed (" + strings.Join(names, ", ") + ")"
+}
+
+// normalizedStat returns the ppm of resource (cpu or memory) and the stat it
+// is read from. A single hypervisor type uses the stat of the hypervisor,
+// mixed clusters and hypervisors without a specific stat use the aggregated
+// hypervisor_<resource>_usage_ppm. Without the aggregate the hypervisor
+// specific stats are weighted by the number of hosts of the hypervisor in
+// hostCounts. -1 is returned if no stat is available.
+func normalizedStat(stats map[string]string, types []string, hostCounts map[string]int, resource string) (int64, string) {
+	generic := "hypervisor_" + resource + "_usage_ppm"
+	if len(types) == 1 {
+		if h, ok := hypervisorStats[types[0]]; ok {
+			name := "hypervisor_" + h.stat + "_" + resource + "_usage_ppm"
+			if v := statValue(stats[name]); v >= 0 {
+				return v, name
+			}
+		}
+	}
+	if v := statValue(stats[generic]); v >= 0 {
+		return v, generic
+	}
+
+	// no aggregate: the mean of the hypervisor specific stats weighted by
+	// the hosts, a hypervisor without known hosts counts as one host
+	var sum, n int64
+	var names []string
+	for _, t := range types {
+		if h, ok := hypervisorStats[t]; ok {
+			name := "hypervisor_" + h.stat + "_" + resource + "_usage_ppm"
+			if v := statValue(stats[name]); v >= 0 {
+				w := int64(hostCounts[t])
+				if w < 1 {
+					w = 1
+				}
+				sum += v * w
+				n += w
+				names = append(names, fmt.Sprintf("%s*%d", name, w))
+			}
+		}
+	}
+	if n == 0 {
+		return -1, ""
+	}
+	return sum / n, "mean(" + strings.Join(names, ",") + ")"
+}
+
+// newUtilization returns the normalized utilization of the stats.
+// hostCounts are the number of hosts per hypervisor type of a cluster.
+func newUtilization(kind string, name string, cluster string, types []string, hostCounts map[string]int, stats map[string]string) utilization {
+	u := utilization{Kind: kind, Name: name, Cluster: cluster, Hypervisor: hypervisorName(types), CPUPercent: -1, MemoryPercent: -1}
+	if v, stat := normalizedStat(stats, types, hostCounts, "cpu"); v >= 0 {
+		u.CPUPercent, u.CPUStat = float64(v)/1e4, stat
+	}
+	if v, stat := normalizedStat(stats, types, hostCounts, "memory"); v >= 0 {
+		u.MemoryPercent, u.MemoryStat = float64(v)/1e4, stat
+	}
+	return u
+}
+
+// utilizations returns the utilization of all clusters and their hosts
+func (c *client) utilizations() ([]utilization, error) {
+	out := []utilization{}
+	for _, cc := range c.all() {
+		clusters, err := cc.listClusters()
+		if err != nil {
+			return nil, err
+		}
+		hosts, err := cc.listHosts()
+		if err != nil {
+			return nil, err
+		}
+		for _, ci := range clusters {
+			var hus []utilization
+			hostCounts := make(map[string]int)
+			for _, h := range hosts {
+				if h.ClusterUUID == ci.UUID || h.ClusterUUID == "" && len(clusters) == 1 {
+					hostCounts[h.HypervisorType]++
+					hus = append(hus, newUtilization("host", h.Name, ci.Name, []string{h.HypervisorType}, nil, h.Stats))
+				}
+			}
+			out = append(out, newUtilization("cluster", ci.Name, ci.Name, ci.HypervisorTypes, hostCounts, ci.Stats.values()))
+			out = append(out, hus...)
+		}
+	}
+	return out, nil
+}
+
+// percent formats a utilization, -1 is not available
+func percent(p float64) string {
+	if p < 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f%%", p)
+}
+
+// runUtilization is the "utilization" command
+func runUtilization(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("utilization", flag.ExitOnError)
+	var jsonOut = fs.Bool("json", false, "print the utilization as JSON")
+	var verbose = fs.Bool("v", false, "show the stats the values are read from")
+	fs.Parse(args)
+
+	us, err := c.utilizations()
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(us)
+	}
+
+	fmt.Printf("%-8s %-20s %-16s %-20s %8s %8s\n", "KIND", "NAME", "CLUSTER", "HYPERVISOR", "CPU", "MEMORY")
+	for _, u := range us {
+		fmt.Printf("%-8s %-20s %-16s %-20s %8s %8s\n", u.Kind, u.Name, u.Cluster, u.Hypervisor, percent(u.CPUPercent), percent(u.MemoryPercent))
+		if *verbose {
+			fmt.Printf("%-8s cpu from %s, memory from %s\n", "", orNone(u.CPUStat), orNone(u.MemoryStat))
+		}
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "utilization", usage: "show the CPU and memory utilization of clusters and hosts for all hypervisors", run: runUtilization})
+}
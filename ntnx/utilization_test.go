@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestNormalizedStat(t *testing.T) {
+
+	stats := map[string]string{
+		"hypervisor_cpu_usage_ppm":        "150000",
+		"hypervisor_kvm_cpu_usage_ppm":    "100000",
+		"hypervisor_esx_cpu_usage_ppm":    "400000",
+		"hypervisor_kvm_memory_usage_ppm": "200000",
+		"hypervisor_esx_memory_usage_ppm": "600000",
+		"hypervisor_hyperv_cpu_usage_ppm": "-1",
+	}
+	mixed := []string{"kKvm", "kVMware"}
+
+	for _, tt := range []struct {
+		name       string
+		types      []string
+		hostCounts map[string]int
+		resource   string
+		want       int64
+		stat       string
+	}{
+		{"single hypervisor uses its stat", []string{"kKvm"}, nil, "cpu", 100000, "hypervisor_kvm_cpu_usage_ppm"},
+		{"unavailable specific stat uses the aggregate", []string{"kHyperv"}, nil, "cpu", 150000, "hypervisor_cpu_usage_ppm"},
+		{"mixed uses the aggregate", mixed, map[string]int{"kKvm": 3, "kVMware": 1}, "cpu", 150000, "hypervisor_cpu_usage_ppm"},
+		{"mixed without aggregate is weighted by hosts", mixed, map[string]int{"kKvm": 3, "kVMware": 1}, "memory", 300000,
+			"mean(hypervisor_kvm_memory_usage_ppm*3,hypervisor_esx_memory_usage_ppm*1)"},
+		{"unknown host counts weigh one", mixed, nil, "memory", 400000,
+			"mean(hypervisor_kvm_memory_usage_ppm*1,hypervisor_esx_memory_usage_ppm*1)"},
+		{"no stat", []string{"kHyperv"}, nil, "memory", -1, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stat := normalizedStat(stats, tt.types, tt.hostCounts, tt.resource)
+			if got != tt.want || stat != tt.stat {
+				t.Errorf("got %d from %q, want %d from %q", got, stat, tt.want, tt.stat)
+			}
+		})
+	}
+}
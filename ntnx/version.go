@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// aosVersion is a parsed AOS version. The cluster sends the version as
+// "5.0.1" and the full version as "el7.3-release-euphrates-5.0.1-stable-<sha>".
+// Builds of the master branch have no number and are newer than all releases.
+type aosVersion struct {
+	Parts  []int  // 5, 0, 1
+	Branch string // euphrates
+	Master bool
+	Raw    string
+}
+
+// parseAOSVersion parses a version or full version. The first part which
+// is a dotted number is the version, the part before it the branch. It
+// accepts other dotted versions like "ncc-3.0.1" as well.
+func parseAOSVersion(s string) (aosVersion, error) {
+
+	v := aosVersion{Raw: s}
+	fields := strings.Split(strings.TrimSpace(s), "-")
+	for i, f := range fields {
+		parts, ok := parseDotted(f)
+		if !ok {
+			continue
+		}
+		v.Parts = parts
+		if i > 0 && fields[i-1] != "release" {
+			v.Branch = fields[i-1]
+		}
+		return v, nil
+	}
+	for _, f := range fields {
+		if f == "master" {
+			v.Master = true
+			return v, nil
+		}
+	}
+	return v, fmt.Errorf("invalid AOS version %q", s)
+}
+
+// parseDotted parses "5.10.2". A single number is not a version because it
+// could be a build number of the full version.
+func parseDotted(s string) ([]int, bool) {
+	var parts []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, len(parts) > 1
+}
+
+// mustParseAOSVersion parses the version of a constant and panics if it is
+// invalid
+func mustParseAOSVersion(s string) aosVersion {
+	v, err := parseAOSVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// String returns the version like "5.0.1" or "master"
+func (v aosVersion) String() string {
+	if v.Master {
+		return "master"
+	}
+	var parts []string
+	for _, p := range v.Parts {
+		parts = append(parts, strconv.Itoa(p))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare returns -1, 0 or 1 if v is older, the same or newer than o.
+// Missing parts count as 0, so 5.10 is the same as 5.10.0.
+func (v aosVersion) Compare(o aosVersion) int {
+	switch {
+	case v.Master && o.Master:
+		return 0
+	case v.Master:
+		return 1
+	case o.Master:
+		return -1
+	}
+	for i := 0; i < len(v.Parts) || i < len(o.Parts); i++ {
+		var x, y int
+		if i < len(v.Parts) {
+			x = v.Parts[i]
+		}
+		if i < len(o.Parts) {
+			y = o.Parts[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast returns true if v is min or newer
+func (v aosVersion) AtLeast(min aosVersion) bool { return v.Compare(min) >= 0 }
+
+// aosFeatures are the minimum AOS versions of the features the client uses
+var aosFeatures = map[string]aosVersion{
+	"v3 API":  mustParseAOSVersion("5.5"),
+	"hot-add": mustParseAOSVersion("5.0"), // memory and vCPUs of running AHV VMs
+}
+
+// aosEndpoints maps API URL prefixes to the feature they need
+var aosEndpoints = map[string]string{
+	"/api/nutanix/v3/": "v3 API",
+}
+
+// aosVersionError is returned if the cluster is too old for a feature
+type aosVersionError struct {
+	Feature string
+	Host    string
+	Min     aosVersion
+	Actual  aosVersion
+}
+
+func (e *aosVersionError) Error() string {
+	return fmt.Sprintf("%s requires AOS >= %s, %s runs AOS %s", e.Feature, e.Min, e.Host, e.Actual)
+}
+
+// aosCache holds the version of a host. Only a successful lookup is cached,
+// a failed lookup is retried with the next call.
+type aosCache struct {
+	mu      sync.Mutex
+	looked  bool
+	known   bool
+	version aosVersion
+}
+
+// aosVersion returns the AOS version of the cluster of the host. The full
+// version is preferred because it names the branch. known is false if the
+// host sends a version which is not an AOS version like a Prism Central.
+func (c *client) aosVersion() (v aosVersion, known bool, err error) {
+	cache := c.aos
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.looked {
+		return cache.version, cache.known, nil
+	}
+
+	clusters, err := c.listClusters()
+	if err != nil {
+		return v, false, fmt.Errorf("lookup AOS version: %v", err)
+	}
+	if len(clusters) == 0 {
+		return v, false, fmt.Errorf("lookup AOS version: %s returned no cluster", c.host)
+	}
+	v, err = clusters[0].aosVersion()
+	cache.looked, cache.known, cache.version = true, err == nil, v
+	return v, err == nil, nil
+}
+
+// aosVersion returns the parsed version of the cluster
+func (ci clusterInfo) aosVersion() (aosVersion, error) {
+	if v, err := parseAOSVersion(ci.FullVersion); err == nil {
+		return v, nil
+	}
+	return parseAOSVersion(ci.Version)
+}
+
+// requireAOS returns an aosVersionError if the cluster is older than the
+// minimum version of feature and the error if the version can not be looked
+// up. Hosts with an unknown version like a Prism Central are not gated, the
+// API decides then.
+func (c *client) requireAOS(feature string) error {
+	min, ok := aosFeatures[feature]
+	if !ok {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	v, known, err := c.aosVersion()
+	if err != nil {
+		return err
+	}
+	if known && !v.AtLeast(min) {
+		return &aosVersionError{Feature: feature, Host: c.host, Min: min, Actual: v}
+	}
+	return nil
+}
+
+// requireAOSForURL gates the endpoints in aosEndpoints
+func (c *client) requireAOSForURL(url string) error {
+	for prefix, feature := range aosEndpoints {
+		if strings.Contains(url, ":9440"+prefix) {
+			return c.requireAOS(feature)
+		}
+	}
+	return nil
+}
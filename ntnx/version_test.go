@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAOSVersion(t *testing.T) {
+
+	for _, tt := range []struct {
+		in     string
+		parts  []int
+		branch string
+		master bool
+		err    bool
+	}{
+		{in: "5.0.1", parts: []int{5, 0, 1}},
+		{in: "5.10", parts: []int{5, 10}},
+		{in: " 5.10.2 ", parts: []int{5, 10, 2}},
+		{in: "el7.3-release-euphrates-5.0.1-stable-9a3d8b9", parts: []int{5, 0, 1}, branch: "euphrates"},
+		{in: "el7.3-release-5.5-stable-abc", parts: []int{5, 5}},
+		{in: "ncc-3.0.1", parts: []int{3, 0, 1}, branch: "ncc"},
+		{in: "el7.3-opt-master-1234", master: true},
+		{in: "5", err: true},
+		{in: "5.x", err: true},
+		{in: "5.-1", err: true},
+		{in: "", err: true},
+		{in: "unknown", err: true},
+	} {
+		v, err := parseAOSVersion(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", tt.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(v.Parts, tt.parts) || v.Branch != tt.branch || v.Master != tt.master {
+			t.Errorf("%q: got %+v, want parts %v branch %q master %v", tt.in, v, tt.parts, tt.branch, tt.master)
+		}
+	}
+}
+
+func TestAOSVersionCompare(t *testing.T) {
+
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"5.0.1", "5.0.1", 0},
+		{"5.10", "5.10.0", 0},
+		{"5.10", "5.9.2", 1},
+		{"5.0", "5.0.1", -1},
+		{"5.5", "5.10", -1},
+		{"el7.3-release-euphrates-5.0.1-stable-abc", "5.0.1", 0},
+		{"el7.3-opt-master-1234", "6.0", 1},
+		{"5.20", "el7.3-opt-master-1234", -1},
+		{"el7.3-opt-master-1", "el7.3-opt-master-2", 0},
+	} {
+		a, b := mustParseAOSVersion(tt.a), mustParseAOSVersion(tt.b)
+		if got := a.Compare(b); got != tt.want {
+			t.Errorf("%s vs %s: got %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAOSVersionString(t *testing.T) {
+	for in, want := range map[string]string{
+		"5.0.1": "5.0.1",
+		"el7.3-release-euphrates-5.10.2-stable-abc": "5.10.2",
+		"el7.3-opt-master-1":                        "master",
+	} {
+		if got := mustParseAOSVersion(in).String(); got != want {
+			t.Errorf("%q: got %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// vmDisk is a disk of a VM as returned by the v2 API with include_vm_disk_config
+type vmDisk struct {
+	IsCdrom     bool `json:"is_cdrom"`
+	DiskAddress struct {
+		DeviceBus   string `json:"device_bus"`
+		DeviceIndex int    `json:"device_index"`
+		VMDiskUUID  string `json:"vmdisk_uuid"`
+		DeviceUUID  string `json:"device_uuid"`
+	} `json:"disk_address"`
+	Size                 int64  `json:"size"`
+	StorageContainerUUID string `json:"storage_container_uuid"`
+}
+
+// vmNic is a NIC of a VM as returned by the v2 API with include_vm_nic_config
+type vmNic struct {
+	MacAddress         string   `json:"mac_address"`
+	NetworkUUID        string   `json:"network_uuid"`
+	RequestedIPAddress string   `json:"requested_ip_address"`
+	IPAddress          string   `json:"ip_address"`
+	IPAddresses        []string `json:"ip_addresses"`
+	Model              string   `json:"model"`
+	NicUUID            string   `json:"nic_uuid"`
+}
+
+// vm is a VM as returned by the v2 /vms API
+type vm struct {
+	UUID            string   `json:"uuid"`
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	PowerState      string   `json:"power_state"`
+	MemoryMB        int      `json:"memory_mb"`
+	NumVcpus        int      `json:"num_vcpus"`
+	NumCoresPerVcpu int      `json:"num_cores_per_vcpu"`
+	HostUUID        string   `json:"host_uuid"`
+	VMDiskInfo      []vmDisk `json:"vm_disk_info"`
+	VMNics          []vmNic  `json:"vm_nics"`
+}
+
+// vmsGet is the v2 /vms response
+type vmsGet struct {
+	Metadata struct {
+		GrandTotalEntities int `json:"grand_total_entities"`
+		TotalEntities      int `json:"total_entities"`
+	} `json:"metadata"`
+	Entities []vm `json:"entities"`
+}
+
+// listVMs returns all VMs including their disk and NIC config
+func (c *client) listVMs() ([]vm, error) {
+	var resp vmsGet
+	if err := c.get(c.v2("/vms/?include_vm_disk_config=true&include_vm_nic_config=true"), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Entities, nil
+}
+
+// getVM returns the VM with the uuid including its disk and NIC config
+func (c *client) getVM(uuid string) (*vm, error) {
+	var v vm
+	if err := c.get(c.v2("/vms/"+uuid+"?include_vm_disk_config=true&include_vm_nic_config=true"), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
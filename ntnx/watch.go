@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventType is the type of a watch event
+type eventType string
+
+// the event types of a watch, errors of a single poll are send as events and
+// do not stop the watch
+const (
+	eventAdded    eventType = "ADDED"
+	eventModified eventType = "MODIFIED"
+	eventDeleted  eventType = "DELETED"
+	eventError    eventType = "ERROR"
+)
+
+// watchKinds maps the resource types which can be watched to their v2 list
+var watchKinds = map[string]string{
+	"vms":      "/vms/?include_vm_nic_config=true&include_vm_disk_config=true",
+	"hosts":    "/hosts/",
+	"clusters": "/clusters/",
+	"networks": "/networks/",
+	"images":   "/images/",
+}
+
+// fieldDiff is a changed field of a modified resource. Nested fields are
+// addressed with dots, e.g. vm_nics.0.ip_address.
+type fieldDiff struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// watchEvent is a change of a watched resource
+type watchEvent struct {
+	Type    eventType   `json:"type"`
+	Kind    string      `json:"kind"`
+	UUID    string      `json:"uuid,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Time    time.Time   `json:"time"`
+	Changes []fieldDiff `json:"changes,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// watchOptions are the options of a watch
+type watchOptions struct {
+	Kind     string
+	Interval time.Duration
+	Ignore   []string
+	Initial  bool
+}
+
+// watcher lists a resource type periodically and compares it with the
+// previous list by UUID
+type watcher struct {
+	c        *client
+	o        watchOptions
+	previous map[string]map[string]interface{}
+}
+
+// watch starts a watch of the resource type and returns the channel of the
+// events. The watch runs until stop is closed, then the channel is closed.
+func (c *client) watch(o watchOptions, stop <-chan struct{}) (<-chan watchEvent, error) {
+
+	if _, ok := watchKinds[o.Kind]; !ok {
+		return nil, fmt.Errorf("unknown resource type %q", o.Kind)
+	}
+	if o.Interval <= 0 {
+		return nil, fmt.Errorf("interval %s has to be positive", o.Interval)
+	}
+
+	events := make(chan watchEvent)
+	w := &watcher{c: c, o: o}
+
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(o.Interval)
+		defer ticker.Stop()
+
+		for {
+			for _, e := range w.poll() {
+				select {
+				case events <- e:
+				case <-stop:
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// poll lists the resources once and returns the events since the last poll
+func (w *watcher) poll() []watchEvent {
+
+	now := time.Now().UTC()
+
+	var resp struct {
+		Entities []map[string]interface{} `json:"entities"`
+	}
+	if err := w.c.get(w.c.v2(watchKinds[w.o.Kind]), &resp); err != nil {
+		return []watchEvent{{Type: eventError, Kind: w.o.Kind, Time: now, Error: err.Error()}}
+	}
+
+	current := make(map[string]map[string]interface{})
+	for _, e := range resp.Entities {
+		for _, field := range w.o.Ignore {
+			delete(e, field)
+		}
+		current[entityUUID(e)] = e
+	}
+
+	// the first list is the baseline and only reported with Initial
+	first := w.previous == nil
+	previous := w.previous
+	w.previous = current
+	if first && !w.o.Initial {
+		return nil
+	}
+
+	var events []watchEvent
+
+	for _, uuid := range sortedUUIDs(current) {
+		e := current[uuid]
+		old, ok := previous[uuid]
+		if !ok {
+			events = append(events, watchEvent{Type: eventAdded, Kind: w.o.Kind, UUID: uuid, Name: entityName(e), Time: now})
+			continue
+		}
+		if changes := diffFields(old, e); len(changes) > 0 {
+			events = append(events, watchEvent{Type: eventModified, Kind: w.o.Kind, UUID: uuid, Name: entityName(e), Time: now, Changes: changes})
+		}
+	}
+
+	for _, uuid := range sortedUUIDs(previous) {
+		if _, ok := current[uuid]; !ok {
+			events = append(events, watchEvent{Type: eventDeleted, Kind: w.o.Kind, UUID: uuid, Name: entityName(previous[uuid]), Time: now})
+		}
+	}
+
+	return events
+}
+
+// entityUUID returns the UUID of an entity of any v2 list
+func entityUUID(e map[string]interface{}) string {
+	for _, key := range []string{"uuid", "storage_container_uuid", "cluster_uuid"} {
+		if s, ok := e[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return entityName(e)
+}
+
+// entityName returns the name of an entity of any v2 list
+func entityName(e map[string]interface{}) string {
+	s, _ := e["name"].(string)
+	return s
+}
+
+// sortedUUIDs returns the keys of m in order
+func sortedUUIDs(m map[string]map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flatten adds all leaf values of v to out with their dotted path
+func flatten(prefix string, v interface{}, out map[string]interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			flatten(joinPath(prefix, k), e, out)
+		}
+	case []interface{}:
+		for i, e := range t {
+			flatten(joinPath(prefix, strconv.Itoa(i)), e, out)
+		}
+	default:
+		out[prefix] = v
+	}
+}
+
+// joinPath joins two parts of a dotted path
+func joinPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// diffFields returns all fields which differ between old and new
+func diffFields(old map[string]interface{}, new map[string]interface{}) []fieldDiff {
+
+	a := make(map[string]interface{})
+	b := make(map[string]interface{})
+	flatten("", old, a)
+	flatten("", new, b)
+
+	fields := make(map[string]bool)
+	for k := range a {
+		fields[k] = true
+	}
+	for k := range b {
+		fields[k] = true
+	}
+
+	var names []string
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var diffs []fieldDiff
+	for _, k := range names {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			diffs = append(diffs, fieldDiff{Field: k, Old: a[k], New: b[k]})
+		}
+	}
+	return diffs
+}
+
+// runWatch is the "watch" command
+func runWatch(c *client, args []string) error {
+
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	var o watchOptions
+	fs.StringVar(&o.Kind, "type", "vms", "resource type: vms, hosts, clusters, networks or images")
+	fs.DurationVar(&o.Interval, "interval", 10*time.Second, "time between two lists")
+	var ignore = fs.String("ignore", "stats,usage_stats", "comma separated top level fields which are not compared")
+	fs.BoolVar(&o.Initial, "initial", false, "report the existing resources as ADDED on start")
+	fs.Parse(args)
+
+	if *ignore != "" {
+		o.Ignore = strings.Split(*ignore, ",")
+	}
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	events, err := c.watch(o, stop)
+	if err != nil {
+		return err
+	}
+
+	// every event is written as a single JSON line
+	enc := json.NewEncoder(os.Stdout)
+	for e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	register(command{name: "watch", usage: "stream changes of VMs, hosts, clusters, networks or images as JSON lines", run: runWatch})
+}
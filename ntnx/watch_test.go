@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(`{"name":"web","nics":[{"ip":"10.0.0.5"},{"ip":null}],"spec":{"vcpus":2,"tags":[]}}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]interface{})
+	flatten("", v, got)
+	want := map[string]interface{}{
+		"name":       "web",
+		"nics.0.ip":  "10.0.0.5",
+		"nics.1.ip":  nil,
+		"spec.vcpus": float64(2),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+
+	for _, tt := range []struct {
+		name     string
+		old, new string
+		want     []fieldDiff
+	}{
+		{"equal", `{"a":1,"b":{"c":"x"}}`, `{"b":{"c":"x"},"a":1}`, nil},
+		{"changed leaf", `{"power_state":"on"}`, `{"power_state":"off"}`,
+			[]fieldDiff{{Field: "power_state", Old: "on", New: "off"}}},
+		{"added and removed", `{"a":1}`, `{"b":2}`,
+			[]fieldDiff{{Field: "a", Old: float64(1)}, {Field: "b", New: float64(2)}}},
+		{"nested sorted by path", `{"z":1,"nics":[{"ip":"1"}]}`, `{"z":2,"nics":[{"ip":"2"},{"ip":"3"}]}`,
+			[]fieldDiff{{Field: "nics.0.ip", Old: "1", New: "2"}, {Field: "nics.1.ip", New: "3"}, {Field: "z", Old: float64(1), New: float64(2)}}},
+		{"type change", `{"a":"1"}`, `{"a":1}`,
+			[]fieldDiff{{Field: "a", Old: "1", New: float64(1)}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var old, new map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.old), &old); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.new), &new); err != nil {
+				t.Fatal(err)
+			}
+			if got := diffFields(old, new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
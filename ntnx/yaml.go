@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The Go standard library has no YAML support. yamlToJSON understands the
+// block style subset of YAML used by spec files and manifests: mappings,
+// sequences, plain and quoted scalars, literal (|) and folded (>) block
+// scalars, simple flow sequences and comments. Anchors and tags are not
+// supported, multiple documents are split by splitDocuments.
+//
+// Plain scalars are typed by the field they are decoded into, so a name
+// "007" or a version 5.10 stay strings. Without a typed field only true,
+// false and numbers are converted, yes and no stay strings as in YAML 1.2.
+
+// yamlPlain is an unquoted scalar whose type depends on the target field
+type yamlPlain string
+
+// MarshalJSON marshals the plain scalar by its inferred type
+func (s yamlPlain) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.infer())
+}
+
+// infer returns the bool, number or string of the plain scalar
+func (s yamlPlain) infer() interface{} {
+	if b, ok := s.bool(); ok {
+		return b
+	}
+	if i, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(string(s), 64); err == nil {
+		return f
+	}
+	return string(s)
+}
+
+// bool returns the value of true or false
+func (s yamlPlain) bool() (bool, bool) {
+	switch s {
+	case "true", "True", "TRUE":
+		return true, true
+	case "false", "False", "FALSE":
+		return false, true
+	}
+	return false, false
+}
+
+// yamlLine is a single non empty line of a YAML document
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlParser holds the lines of the document and the current position
+type yamlParser struct {
+	lines []yamlLine
+	raw   []string
+	pos   int
+}
+
+// decodeSpec unmarshals data into v. Files ending with .json are read as
+// JSON, all others as YAML. Unknown fields are reported to catch typos.
+func decodeSpec(name string, data []byte, v interface{}) error {
+	if !strings.EqualFold(filepath.Ext(name), ".json") {
+		var err error
+		if data, err = yamlToJSON(data, v); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// splitDocuments splits a YAML stream at the "---" document separators
+func splitDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	var cur []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimRight(line, " \r") == "---" {
+			docs = append(docs, []byte(strings.Join(cur, "\n")))
+			cur = nil
+			continue
+		}
+		cur = append(cur, line)
+	}
+	docs = append(docs, []byte(strings.Join(cur, "\n")))
+
+	var out [][]byte
+	for _, d := range docs {
+		if v, err := parseYAML(d); err != nil || v != nil {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// yamlToJSON converts the YAML document into JSON. The plain scalars are
+// typed by the fields of target, a nil target infers their types.
+func yamlToJSON(data []byte, target interface{}) ([]byte, error) {
+	v, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	if target != nil {
+		v = resolveYAML(v, reflect.TypeOf(target))
+	}
+	return json.Marshal(v)
+}
+
+// resolveYAML converts the plain scalars of v to the kind of t. Values which
+// do not fit are kept as string so the JSON decoder reports them.
+func resolveYAML(v interface{}, t reflect.Type) interface{} {
+
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := v.(type) {
+	case yamlPlain:
+		if t == nil {
+			return v
+		}
+		switch t.Kind() {
+		case reflect.String:
+			return string(v)
+		case reflect.Bool:
+			if b, ok := v.bool(); ok {
+				return b
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			switch n := v.infer().(type) {
+			case int64, float64:
+				return n
+			}
+		case reflect.Interface:
+			return v
+		}
+		return string(v)
+
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := range v {
+			v[i] = resolveYAML(v[i], elem)
+		}
+
+	case map[string]interface{}:
+		for key, value := range v {
+			var field reflect.Type
+			switch {
+			case t == nil:
+			case t.Kind() == reflect.Map:
+				field = t.Elem()
+			case t.Kind() == reflect.Struct:
+				field = jsonField(t, key)
+			}
+			v[key] = resolveYAML(value, field)
+		}
+	}
+	return v
+}
+
+// jsonField returns the type of the field the JSON decoder uses for key, the
+// fields of embedded structs included
+func jsonField(t reflect.Type, key string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			if ft := jsonField(f.Type, key); ft != nil {
+				return ft
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name != "-" && strings.EqualFold(name, key) {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+// parseYAML parses the YAML document into maps, slices and scalars
+func parseYAML(data []byte) (interface{}, error) {
+
+	p := &yamlParser{raw: strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")}
+
+	for i, raw := range p.raw {
+		if strings.Contains(raw, "\t") && strings.TrimLeft(raw, " ") != strings.TrimLeft(raw, " \t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimLeft(raw, " ")
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(text), text: strings.TrimRight(text, " ")})
+	}
+
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := p.parseNode(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+// parseNode parses the mapping or sequence starting at the current line
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseScalar(stripComment(l.text), l.num)
+}
+
+// parseSequence parses all "- " items at indent
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+
+	seq := []interface{}{}
+
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !(l.text == "-" || strings.HasPrefix(l.text, "- ")) {
+			break
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+
+		if rest == "" {
+			// the item is a nested node on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				seq = append(seq, nil)
+				continue
+			}
+			v, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		// "- key: value" starts a mapping indented by the "- " prefix, the
+		// line is replaced by the mapping line and parsed again
+		itemIndent := indent + len(l.text) - len(rest)
+		if _, _, ok := splitKey(rest); ok || rest == "-" || strings.HasPrefix(rest, "- ") {
+			p.lines[p.pos] = yamlLine{num: l.num, indent: itemIndent, text: rest}
+			v, err := p.parseNode(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		p.pos++
+		v, err := p.parseValue(rest, indent, l.num)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+
+	return seq, nil
+}
+
+// parseMapping parses all "key: value" lines at indent
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+
+	m := map[string]interface{}{}
+
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent {
+			if l.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+			}
+			break
+		}
+
+		key, value, ok := splitKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+
+		value = stripComment(value)
+		if value != "" {
+			v, err := p.parseValue(value, indent, l.num)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+
+		// the value is a nested node, sequences may be on the same indent as the key
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			isSeq := next.text == "-" || strings.HasPrefix(next.text, "- ")
+			if next.indent > indent || next.indent == indent && isSeq {
+				v, err := p.parseNode(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = nil
+	}
+
+	return m, nil
+}
+
+// parseValue parses the value after "key:" or "- ". Block scalars read the
+// following raw lines which are indented deeper than indent.
+func (p *yamlParser) parseValue(value string, indent int, num int) (interface{}, error) {
+	if value == "|" || value == "|-" || value == ">" || value == ">-" {
+		return p.parseBlockScalar(value, indent, num), nil
+	}
+	return parseScalar(value, num)
+}
+
+// parseBlockScalar reads a literal or folded block scalar starting after line num
+func (p *yamlParser) parseBlockScalar(style string, indent int, num int) string {
+
+	var lines []string
+	blockIndent := -1
+
+	// the raw lines are used because blank lines and comments are content
+	i := num
+	for ; i < len(p.raw); i++ {
+		raw := p.raw[i]
+		text := strings.TrimLeft(raw, " ")
+		if text == "" {
+			lines = append(lines, "")
+			continue
+		}
+		ind := len(raw) - len(text)
+		if ind <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = ind
+		}
+		if ind < blockIndent {
+			break
+		}
+		lines = append(lines, raw[blockIndent:])
+	}
+
+	// skip the parsed lines which belong to the block
+	for p.pos < len(p.lines) && p.lines[p.pos].num <= i {
+		p.pos++
+	}
+
+	// trailing blank lines are not part of the block
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var s string
+	if strings.HasPrefix(style, ">") {
+		s = strings.Replace(strings.Join(lines, "\n"), "\n\n", "\x00", -1)
+		s = strings.Replace(s, "\n", " ", -1)
+		s = strings.Replace(s, "\x00", "\n", -1)
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+
+	if !strings.HasSuffix(style, "-") && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+// splitKey splits "key: value" into key and value
+func splitKey(text string) (string, string, bool) {
+
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		rest := text[end+2:]
+		if rest == ":" || strings.HasPrefix(rest, ": ") {
+			return text[1 : end+1], strings.TrimSpace(strings.TrimPrefix(rest, ":")), true
+		}
+		return "", "", false
+	}
+
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if strings.HasSuffix(text, ":") {
+			return strings.TrimSpace(text[:len(text)-1]), "", true
+		}
+		return "", "", false
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), true
+}
+
+// stripComment removes a trailing " # comment" outside of quotes
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimRight(s[:i], " ")
+		}
+	}
+	return s
+}
+
+// parseScalar converts a plain, quoted or flow scalar into a Go value. Plain
+// scalars are returned as yamlPlain and typed by resolveYAML.
+func parseScalar(s string, num int) (interface{}, error) {
+
+	switch {
+	case strings.HasPrefix(s, "\""):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", num, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", num, s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("line %d: flow sequences have to end on the same line", num)
+		}
+		seq := []interface{}{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return seq, nil
+		}
+		for _, item := range strings.Split(inner, ",") {
+			v, err := parseScalar(strings.TrimSpace(item), num)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("line %d: flow mappings are not supported", num)
+	}
+
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	}
+	return yamlPlain(s), nil
+}
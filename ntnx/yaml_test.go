@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"mapping", "a: 1\nb: text\n", `{"a":1,"b":"text"}`},
+		{"nested mapping", "a:\n  b:\n    c: x\n", `{"a":{"b":{"c":"x"}}}`},
+		{"sequence", "- a\n- b\n", `["a","b"]`},
+		{"sequence under key", "a:\n- 1\n- 2\n", `{"a":[1,2]}`},
+		{"sequence of mappings", "- a: 1\n  b: 2\n- a: 3\n", `[{"a":1,"b":2},{"a":3}]`},
+		{"nested sequence", "- - a\n  - b\n", `[["a","b"]]`},
+		{"empty item", "-\n- a\n", `[null,"a"]`},
+		{"null", "a: ~\nb: null\nc:\n", `{"a":null,"b":null,"c":null}`},
+		{"bool", "a: true\nb: False\n", `{"a":true,"b":false}`},
+		{"yes and no are strings", "a: yes\nb: no\n", `{"a":"yes","b":"no"}`},
+		{"float", "a: 1.5\n", `{"a":1.5}`},
+		{"double quoted", `a: "x: \"y\"\n"`, `{"a":"x: \"y\"\n"}`},
+		{"single quoted", "a: 'it''s'\n", `{"a":"it's"}`},
+		{"quoted number", "a: \"5\"\n", `{"a":"5"}`},
+		{"quoted key", "\"a b\": 1\n", `{"a b":1}`},
+		{"flow sequence", "a: [1, x, \"y\"]\n", `{"a":[1,"x","y"]}`},
+		{"empty flow", "a: []\nb: {}\n", `{"a":[],"b":{}}`},
+		{"comments", "# head\na: 1 # one\nb: x#y\n", `{"a":1,"b":"x#y"}`},
+		{"literal block", "a: |\n  line 1\n\n  line 2\nb: 1\n", `{"a":"line 1\n\nline 2\n","b":1}`},
+		{"literal block strip", "a: |-\n  x\n  y\n", `{"a":"x\ny"}`},
+		{"folded block", "a: >\n  x\n  y\n\n  z\n", `{"a":"x y\nz\n"}`},
+		{"block with comment", "a: |\n  #!/bin/sh\n  # keep\n", `{"a":"#!/bin/sh\n# keep\n"}`},
+		{"windows newlines", "a: 1\r\nb: 2\r\n", `{"a":1,"b":2}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := yamlToJSON([]byte(tt.yaml), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs"},
+		{"duplicate key", "a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"bad indentation", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"flow mapping", "a: {b: 1}\n", "line 1: flow mappings are not supported"},
+		{"open flow sequence", "a: [1,\n", "line 1: flow sequences"},
+		{"bad quote", "a: 'x\n", "line 1: invalid quoted string"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := yamlToJSON([]byte(tt.yaml), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeSpecTypes(t *testing.T) {
+
+	type target struct {
+		Name    string   `json:"name"`
+		Version string   `json:"version"`
+		Count   int      `json:"count"`
+		Ratio   float64  `json:"ratio"`
+		Enabled bool     `json:"enabled"`
+		Tags    []string `json:"tags"`
+		Flag    *bool    `json:"flag"`
+		Extra   map[string]interface{}
+	}
+
+	yes := true
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want target
+		err  string
+	}{
+		{"strings stay strings", "name: 007\nversion: 5.10\ntags: [1, yes, 2.0]\n",
+			target{Name: "007", Version: "5.10", Tags: []string{"1", "yes", "2.0"}}, ""},
+		{"numbers and bools", "count: 4\nratio: 0.5\nenabled: true\nflag: TRUE\n",
+			target{Count: 4, Ratio: 0.5, Enabled: true, Flag: &yes}, ""},
+		{"untyped fields are inferred", "extra:\n  a: 1\n  b: yes\n  c: true\n",
+			target{Extra: map[string]interface{}{"a": float64(1), "b": "yes", "c": true}}, ""},
+		{"yes is no bool", "enabled: yes\n", target{}, "cannot unmarshal string"},
+		{"float is no int", "count: 1.5\n", target{}, "cannot unmarshal number 1.5"},
+		{"unknown field", "nmae: x\n", target{}, "unknown field"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got target
+			err := decodeSpec("spec.yaml", []byte(tt.yaml), &got)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}